@@ -1,55 +1,391 @@
+// Command client is the command line client of the shortener.
 package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+
+	"github.com/n1l/url-shortener/pkg/client"
+)
+
+// The exit codes of the client.
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitNotFound
+	exitAuth
 )
 
+const usage = `usage: client [flags] <command> [args]
+
+commands:
+  shorten [-alias id] [-ttl duration] [-interstitial] [-redirect code] <url>
+  batch [file]             shorten the URLs from the file or stdin, one per line
+  expand <id>              print the original URL
+  list                     list your links
+  delete <id>...           delete your links
+  stats <id>               print the click statistics of your link
+  login <api key>          remember the API key for the server
+  logout                   forget the API key and cookie of the server
+
+An id may also be given as the short URL. Exit codes: 0 success, 1 failure,
+2 usage error, 3 link not found or gone, 4 not authorized.
+
+flags:
+`
+
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+type cli struct {
+	ctx    context.Context
+	api    *client.Client
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
 func main() {
-	endpoint := "http://localhost:8080/"
-	// контейнер данных для запроса
-	data := url.Values{}
-	// приглашение в консоли
-	fmt.Println("Введите длинный URL")
-	// открываем потоковое чтение из консоли
-	reader := bufio.NewReader(os.Stdin)
-	// читаем строку из консоли
-	long, err := reader.ReadString('\n')
-	if err != nil {
-		panic(err)
-	}
-	long = strings.TrimSuffix(long, "\n")
-	// заполняем контейнер данными
-	data.Set("url", long)
-	// добавляем HTTP-клиент
-	client := &http.Client{}
-	// пишем запрос
-	// запрос методом POST должен, помимо заголовков, содержать тело
-	// тело должно быть источником потокового чтения io.Reader
-	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(data.Encode()))
-	if err != nil {
-		panic(err)
-	}
-	// в заголовках запроса указываем кодировку
-	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	// отправляем запрос и получаем ответ
-	response, err := client.Do(request)
-	if err != nil {
-		panic(err)
-	}
-	// выводим код ответа
-	fmt.Println("Статус-код ", response.Status)
-	defer response.Body.Close()
-	// читаем поток из тела ответа
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		panic(err)
-	}
-	// и печатаем его
-	fmt.Println(string(body))
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", envOr("SHORTENER_SERVER", "http://localhost:8080"), "The shortener address, SHORTENER_SERVER")
+	apiKey := fs.String("key", os.Getenv("SHORTENER_API_KEY"), "The API key, SHORTENER_API_KEY, overrides the remembered one")
+	statePath := fs.String("state", envOr("SHORTENER_STATE", defaultStatePath()), "The file remembering the API keys and cookies, SHORTENER_STATE")
+	jsonOut := fs.Bool("json", false, "Print the results as JSON")
+	compress := fs.Bool("gzip", false, "Compress the request bodies")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	st, err := loadState(*statePath)
+	if err != nil {
+		fmt.Fprintln(stderr, "error: failed to read state:", err)
+		return exitFailure
+	}
+	serverURL := strings.TrimSuffix(*server, "/")
+	creds := st.credentials(serverURL)
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "login":
+		if len(cmdArgs) != 1 {
+			fmt.Fprintln(stderr, "error: login takes the API key")
+			return exitUsage
+		}
+		creds.APIKey = cmdArgs[0]
+		return saveState(st, *statePath, stderr)
+	case "logout":
+		delete(st.Servers, serverURL)
+		return saveState(st, *statePath, stderr)
+	}
+
+	key := *apiKey
+	if key == "" {
+		key = creds.APIKey
+	}
+
+	opts := []client.Option{client.WithAPIKey(key), client.WithCookie(creds.Cookie)}
+	if *compress {
+		opts = append(opts, client.WithGzip())
+	}
+	api, err := client.New(serverURL, opts...)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitUsage
+	}
+
+	c := &cli{ctx: context.Background(), api: api, json: *jsonOut, stdin: stdin, stdout: stdout, stderr: stderr}
+	err = c.dispatch(cmd, cmdArgs)
+
+	// the links of a cookie user are reachable only with the same cookie
+	if cookie := api.Cookie(); cookie != creds.Cookie {
+		creds.Cookie = cookie
+		if err := st.save(*statePath); err != nil {
+			fmt.Fprintln(stderr, "warning: failed to save state:", err)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func (c *cli) dispatch(cmd string, args []string) error {
+	switch cmd {
+	case "shorten":
+		return c.shorten(args)
+	case "batch":
+		return c.batch(args)
+	case "expand":
+		return c.expand(args)
+	case "list":
+		return c.list(args)
+	case "delete":
+		return c.delete(args)
+	case "stats":
+		return c.stats(args)
+	default:
+		return &usageError{fmt.Sprintf("unknown command '%s', run with -h for help", cmd)}
+	}
+}
+
+func (c *cli) shorten(args []string) error {
+	fs := flag.NewFlagSet("shorten", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	alias := fs.String("alias", "", "The custom short id")
+	ttl := fs.Duration("ttl", 0, "How long the link lives, forever if zero")
+	interstitial := fs.Bool("interstitial", false, "Show a preview page before redirecting")
+	redirect := fs.Int("redirect", 0, "The redirect status: 301, 302, 307 or 308, the server default if zero")
+	if err := fs.Parse(args); err != nil {
+		return &usageError{err.Error()}
+	}
+	if fs.NArg() != 1 {
+		return &usageError{"shorten takes a single URL"}
+	}
+
+	shortURL, err := c.api.Shorten(c.ctx, client.ShortenRequest{
+		URL:          fs.Arg(0),
+		Alias:        *alias,
+		TTL:          *ttl,
+		Interstitial: *interstitial,
+		RedirectType: *redirect,
+	})
+	existed := errors.Is(err, client.ErrConflict) && shortURL != ""
+	if err != nil && !existed {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(struct {
+			URL     string `json:"result"`
+			Existed bool   `json:"existed"`
+		}{shortURL, existed})
+	}
+	if existed {
+		fmt.Fprintln(c.stderr, "already shortened")
+	}
+	fmt.Fprintln(c.stdout, shortURL)
+	return nil
+}
+
+func (c *cli) batch(args []string) error {
+	if len(args) > 1 {
+		return &usageError{"batch takes at most one file"}
+	}
+
+	in := c.stdin
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	originals, err := readURLs(in)
+	if err != nil {
+		return err
+	}
+	if len(originals) == 0 {
+		return &usageError{"no URLs to shorten"}
+	}
+
+	items := make([]client.BatchItem, 0, len(originals))
+	for i, original := range originals {
+		items = append(items, client.BatchItem{CorrelationID: strconv.Itoa(i), URL: original})
+	}
+
+	resp, err := c.api.ShortenBatch(c.ctx, items)
+	if err != nil {
+		return err
+	}
+
+	results := make([]client.Link, 0, len(resp))
+	for _, item := range resp {
+		i, err := strconv.Atoi(item.CorrelationID)
+		if err != nil || i < 0 || i >= len(originals) {
+			return fmt.Errorf("unexpected correlation id '%s'", item.CorrelationID)
+		}
+		results = append(results, client.Link{ShortURL: item.ShortURL, OriginalURL: originals[i]})
+	}
+
+	return c.printLinks(results)
+}
+
+func (c *cli) expand(args []string) error {
+	if len(args) != 1 {
+		return &usageError{"expand takes a single id"}
+	}
+
+	id := idFromArg(args[0])
+	original, err := c.api.Expand(c.ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(client.Link{ShortURL: id, OriginalURL: original})
+	}
+	fmt.Fprintln(c.stdout, original)
+	return nil
+}
+
+func (c *cli) list(args []string) error {
+	if len(args) != 0 {
+		return &usageError{"list takes no arguments"}
+	}
+
+	links, err := c.api.ListURLs(c.ctx)
+	if err != nil {
+		return err
+	}
+	return c.printLinks(links)
+}
+
+func (c *cli) delete(args []string) error {
+	if len(args) == 0 {
+		return &usageError{"delete takes the ids to delete"}
+	}
+
+	ids := make([]string, 0, len(args))
+	for _, arg := range args {
+		ids = append(ids, idFromArg(arg))
+	}
+
+	if err := c.api.Delete(c.ctx, ids...); err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(struct {
+			Accepted []string `json:"accepted"`
+		}{ids})
+	}
+	fmt.Fprintf(c.stdout, "deletion of %d links accepted\n", len(ids))
+	return nil
+}
+
+func (c *cli) stats(args []string) error {
+	if len(args) != 1 {
+		return &usageError{"stats takes a single id"}
+	}
+
+	stats, err := c.api.Stats(c.ctx, idFromArg(args[0]))
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(stats)
+	}
+	fmt.Fprintf(c.stdout, "clicks:          %d\nunique visitors: %d\n", stats.TotalClicks, stats.UniqueVisitors)
+	for _, day := range stats.Daily {
+		fmt.Fprintf(c.stdout, "  %s  %d\n", day.Date, day.Clicks)
+	}
+	return nil
+}
+
+func (c *cli) printLinks(links []client.Link) error {
+	if c.json {
+		return c.printJSON(links)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, link := range links {
+		fmt.Fprintf(tw, "%s\t%s\n", link.ShortURL, link.OriginalURL)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printJSON(v any) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readURLs skips empty lines and # comments.
+func readURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// idFromArg takes the id from a short URL.
+func idFromArg(arg string) string {
+	if u, err := url.Parse(arg); err == nil && u.Scheme != "" && u.Host != "" {
+		return strings.TrimPrefix(u.Path, "/")
+	}
+	return arg
+}
+
+func exitCode(err error) int {
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, client.ErrUnauthorized), errors.Is(err, client.ErrForbidden):
+		return exitAuth
+	case errors.Is(err, client.ErrNotFound), errors.Is(err, client.ErrGone):
+		return exitNotFound
+	default:
+		return exitFailure
+	}
+}
+
+func saveState(st *state, path string, stderr io.Writer) int {
+	if err := st.save(path); err != nil {
+		fmt.Fprintln(stderr, "error: failed to save state:", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/models"
+	"github.com/n1l/url-shortener/internal/service"
+	"github.com/n1l/url-shortener/internal/storage"
+	"github.com/n1l/url-shortener/internal/zipper"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	store := storage.NewInMemoryStorage()
+	options := config.Options{PublicHost: "http://sho.rt"}
+	services := service.NewService(&options, store, store)
+	t.Cleanup(func() { services.Close() })
+
+	router := chi.NewRouter()
+	router.Use(zipper.GzipMiddleware)
+	router.Use(auth.NewAuthenticator("secret").Middleware)
+	router.Post("/api/shorten", services.CreateShortedURLfromJSONHandler)
+	router.Post("/api/shorten/batch", services.CreateShortedURLBatchHandler)
+	router.Get("/api/urls/{id}", services.GetURLHandler)
+	router.With(auth.RequireUser).Get("/api/user/urls", services.GetUserURLsHandler)
+	router.With(auth.RequireUser).Delete("/api/user/urls", services.DeleteUserURLsHandler)
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRun(t *testing.T) {
+	srv := newTestServer(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	client := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-server", srv.URL, "-state", statePath}, args...)
+		code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, _ := client("", "shorten", "http://google.com")
+	require.Equal(t, exitOK, code)
+	assert.Equal(t, "http://sho.rt/x7kg9X5V\n", out)
+
+	code, out, errOut := client("", "-json", "shorten", "http://google.com")
+	require.Equal(t, exitOK, code, errOut)
+	assert.JSONEq(t, `{"result": "http://sho.rt/x7kg9X5V", "existed": true}`, out)
+
+	urls := filepath.Join(t.TempDir(), "urls.txt")
+	require.NoError(t, os.WriteFile(urls, []byte("http://ya.ru\n\n# skipped\nhttp://go.dev\n"), 0666))
+	code, out, errOut = client("", "-gzip", "batch", urls)
+	require.Equal(t, exitOK, code, errOut)
+	assert.Contains(t, out, "http://ya.ru")
+	assert.Contains(t, out, "http://go.dev")
+
+	code, out, errOut = client("", "-json", "list")
+	require.Equal(t, exitOK, code, errOut)
+	var links []models.UserURLResponseItem
+	require.NoError(t, json.Unmarshal([]byte(out), &links))
+	assert.Len(t, links, 3, "cookie сохраняется между запусками")
+
+	code, out, _ = client("", "expand", "http://sho.rt/x7kg9X5V")
+	require.Equal(t, exitOK, code)
+	assert.Equal(t, "http://google.com\n", out)
+
+	code, out, errOut = client("", "shorten", "-interstitial", "http://go.dev/guarded")
+	require.Equal(t, exitOK, code, errOut)
+	code, out, errOut = client("", "expand", strings.TrimSpace(out))
+	require.Equal(t, exitOK, code, errOut)
+	assert.Equal(t, "http://go.dev/guarded\n", out, "ссылка со страницей предупреждения раскрывается")
+
+	code, _, _ = client("", "expand", "missing")
+	assert.Equal(t, exitNotFound, code)
+
+	code, _, _ = client("", "delete")
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = client("", "unknown")
+	assert.Equal(t, exitUsage, code)
+
+	code, _, _ = client("", "login", "bad.key")
+	require.Equal(t, exitOK, code)
+	code, _, _ = client("", "list")
+	assert.Equal(t, exitAuth, code, "сохранённый ключ отправляется серверу")
+
+	var stderr bytes.Buffer
+	code = run([]string{"-server", srv.URL, "-state", "", "login", "some.key"}, strings.NewReader(""), io.Discard, &stderr)
+	assert.Equal(t, exitFailure, code, "ключ без файла состояния не запоминается")
+	assert.Contains(t, stderr.String(), "-state")
+
+	code, _, _ = client("", "logout")
+	require.Equal(t, exitOK, code)
+	code, out, _ = client("", "list")
+	assert.Equal(t, exitOK, code)
+	assert.Empty(t, out, "после выхода у клиента нет ни ключа, ни cookie")
+}
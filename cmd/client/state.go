@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// state keeps the credentials between the runs, per server.
+type state struct {
+	Servers map[string]*credentials `json:"servers"`
+}
+
+type credentials struct {
+	APIKey string `json:"api_key,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+}
+
+func defaultStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "url-shortener", "client.json")
+}
+
+// loadState returns an empty state if the file does not exist yet.
+func loadState(path string) (*state, error) {
+	st := &state{Servers: make(map[string]*credentials)}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Servers == nil {
+		st.Servers = make(map[string]*credentials)
+	}
+	return st, nil
+}
+
+func (st *state) credentials(server string) *credentials {
+	creds, ok := st.Servers[server]
+	if !ok {
+		creds = &credentials{}
+		st.Servers[server] = creds
+	}
+	return creds
+}
+
+// errNoStatePath is returned when there is no config directory to keep
+// the state in and no -state flag.
+var errNoStatePath = errors.New("no config directory, set -state")
+
+// save writes the file readable by the owner only, it holds secrets.
+func (st *state) save(path string) error {
+	if path == "" {
+		return errNoStatePath
+	}
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
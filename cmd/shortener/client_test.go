@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/service"
+	"github.com/n1l/url-shortener/internal/storage"
+	"github.com/n1l/url-shortener/pkg/client"
+)
+
+func TestClient(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	store := storage.NewInMemoryStorage()
+	services := service.NewService(&options, store, store)
+	defer services.Close()
+
+	authenticator := auth.NewAuthenticator("secret", auth.WithKeyStore(store))
+	srv := httptest.NewServer(serverHandler(services, authenticator))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := client.New(srv.URL, client.WithGzip())
+	require.NoError(t, err)
+
+	short, err := c.Shorten(ctx, client.ShortenRequest{URL: "http://google.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/x7kg9X5V", short)
+	assert.NotEmpty(t, c.Cookie())
+
+	short, err = c.Shorten(ctx, client.ShortenRequest{URL: "http://google.com"})
+	assert.ErrorIs(t, err, client.ErrConflict)
+	assert.Equal(t, "http://example.com/x7kg9X5V", short, "при конфликте возвращается существующая ссылка")
+
+	_, err = c.Shorten(ctx, client.ShortenRequest{URL: "http://ya.ru", Alias: "x7kg9X5V"})
+	assert.ErrorIs(t, err, client.ErrConflict)
+
+	_, err = c.Shorten(ctx, client.ShortenRequest{URL: "javascript:alert(1)"})
+	var apiErr *client.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.ErrorIs(t, err, client.ErrInvalid)
+	assert.Equal(t, service.ReasonSchemeNotAllowed, apiErr.Reason)
+
+	_, err = c.Shorten(ctx, client.ShortenRequest{URL: "http://go.dev", Alias: "golang", TTL: time.Hour})
+	require.NoError(t, err)
+
+	results, err := c.ShortenBatch(ctx, []client.BatchItem{
+		{CorrelationID: "1", URL: "http://eynt73dlmnjj3b.biz/t0pwb"},
+		{CorrelationID: "2", URL: "http://ya.ru"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "1", results[0].CorrelationID)
+
+	original, err := c.Expand(ctx, "x7kg9X5V")
+	require.NoError(t, err)
+	assert.Equal(t, "http://google.com", original)
+
+	_, err = c.Expand(ctx, "missing")
+	assert.ErrorIs(t, err, client.ErrNotFound)
+
+	links, err := c.ListURLs(ctx)
+	require.NoError(t, err)
+	assert.Len(t, links, 4)
+
+	stats, err := c.Stats(ctx, "x7kg9X5V")
+	require.NoError(t, err)
+	assert.Equal(t, "x7kg9X5V", stats.ShortURL)
+
+	_, err = c.Stats(ctx, "missing")
+	assert.ErrorIs(t, err, client.ErrNotFound)
+
+	require.NoError(t, c.Delete(ctx, "x7kg9X5V"))
+	// flushes the pending deletions
+	require.NoError(t, services.Close())
+
+	_, err = c.Expand(ctx, "x7kg9X5V")
+	assert.ErrorIs(t, err, client.ErrGone)
+
+	restored, err := client.New(srv.URL, client.WithCookie(c.Cookie()))
+	require.NoError(t, err)
+	links, err = restored.ListURLs(ctx)
+	require.NoError(t, err)
+	assert.Len(t, links, 3, "сохранённый cookie открывает ссылки пользователя")
+
+	stranger, err := client.New(srv.URL)
+	require.NoError(t, err)
+	links, err = stranger.ListURLs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, links)
+}
+
+func TestClientAPIKey(t *testing.T) {
+	options := config.Options{
+		PublicHost:      "http://example.com",
+		CreateRateLimit: 0.001,
+		CreateRateBurst: 1,
+		RateLimitIdle:   time.Minute,
+	}
+
+	store := storage.NewInMemoryStorage()
+	services := service.NewService(&options, store, store)
+	defer services.Close()
+
+	authenticator := auth.NewAuthenticator("secret", auth.WithKeyStore(store))
+	srv := httptest.NewServer(serverHandler(services, authenticator))
+	defer srv.Close()
+
+	token, _ := createTestKey(t, store, "-user", "jobs")
+
+	ctx := context.Background()
+	c, err := client.New(srv.URL, client.WithAPIKey(token))
+	require.NoError(t, err)
+
+	_, err = c.Shorten(ctx, client.ShortenRequest{URL: "http://google.com"})
+	require.NoError(t, err)
+	assert.Empty(t, c.Cookie())
+
+	_, err = c.Shorten(ctx, client.ShortenRequest{URL: "http://ya.ru"})
+	require.ErrorIs(t, err, client.ErrRateLimited)
+	var apiErr *client.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Greater(t, apiErr.RetryAfter, time.Duration(0))
+
+	err = c.Delete(ctx, "x7kg9X5V")
+	assert.ErrorIs(t, err, client.ErrForbidden)
+
+	bad, err := client.New(srv.URL, client.WithAPIKey("bad.key"), client.WithRetries(0, 0))
+	require.NoError(t, err)
+	_, err = bad.ListURLs(ctx)
+	assert.ErrorIs(t, err, client.ErrUnauthorized)
+}
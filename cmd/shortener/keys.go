@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/storage"
+)
+
+const keysUsage = `usage:
+  shortener keys create [-user id] [-name name] [-scopes shorten,delete,stats]
+  shortener keys list
+  shortener keys revoke <id>`
+
+// manageKeys is run as "shortener keys ...", the running server sees the
+// changes without a restart. With the file storage only the keys file is
+// opened, the other files belong to the server.
+func manageKeys(options *config.Options, args []string, w io.Writer) error {
+	keys, err := openKeyStore(options)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(runKeysCommand(keys, args, w), keys.Close())
+}
+
+type keyStore interface {
+	auth.KeyStore
+	Close() error
+}
+
+func openKeyStore(options *config.Options) (keyStore, error) {
+	if options.DatabaseDSN != "" {
+		return storage.NewPostgresStorage(options.DatabaseDSN)
+	}
+	if options.StoragePath != "" {
+		return storage.NewKeyFile(options.StoragePath)
+	}
+	return nil, errors.New("api keys need a file or database storage")
+}
+
+func runKeysCommand(keys auth.KeyStore, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		return createKey(keys, args[1:], w)
+	case "list":
+		return listKeys(keys, w)
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(keysUsage)
+		}
+		if err := keys.RevokeAPIKey(args[1], time.Now().UTC()); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "revoked %s\n", args[1])
+		return nil
+	default:
+		return errors.New(keysUsage)
+	}
+}
+
+// createKey prints the key once, only its hash is stored. Without -user
+// the key gets an account of its own.
+func createKey(keys auth.KeyStore, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	userID := fs.String("user", "", "The user id owning the links created with the key, a new one if empty")
+	name := fs.String("name", "", "A note on who uses the key")
+	scopes := fs.String("scopes", auth.ScopeShorten, "Comma separated scopes: "+strings.Join(auth.Scopes, ", "))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *userID == "" {
+		var err error
+		if *userID, err = auth.NewUserID(); err != nil {
+			return err
+		}
+	}
+
+	token, key, err := auth.NewAPIKey(*userID, *name, strings.Split(*scopes, ","))
+	if err != nil {
+		return err
+	}
+	if err := keys.SaveAPIKey(key); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "id:     %s\nuser:   %s\nscopes: %s\nkey:    %s\n", key.ID, key.UserID, strings.Join(key.Scopes, ","), token)
+	fmt.Fprintln(w, "The key is shown only once, store it now.")
+	return nil
+}
+
+func listKeys(keys auth.KeyStore, w io.Writer) error {
+	list, err := keys.ListAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tUSER\tSCOPES\tCREATED\tREVOKED")
+	for _, key := range list {
+		revoked := "-"
+		if key.RevokedAt != nil {
+			revoked = key.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			key.ID, key.Name, key.UserID, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), revoked)
+	}
+	return tw.Flush()
+}
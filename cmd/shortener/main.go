@@ -2,56 +2,331 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/certs"
 	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/grpcserver"
+	"github.com/n1l/url-shortener/internal/hasher"
 	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/metrics"
+	"github.com/n1l/url-shortener/internal/models"
 	"github.com/n1l/url-shortener/internal/service"
 	"github.com/n1l/url-shortener/internal/storage"
 	"github.com/n1l/url-shortener/internal/zipper"
 )
 
-func serverHandler(services *service.Service) http.Handler {
+type urlStorage interface {
+	service.URLSaver
+	service.URLGetter
+	storage.Purger
+	auth.KeyStore
+	io.Closer
+	VisitorSalt() (string, error)
+}
+
+func newStorage(options *config.Options) (urlStorage, error) {
+	if options.DatabaseDSN != "" {
+		return storage.NewPostgresStorage(options.DatabaseDSN)
+	}
+	if options.StoragePath != "" {
+		return newFileStorage(options)
+	}
+	return storage.NewInMemoryStorage(), nil
+}
+
+// instrumentedStorage records the latencies of the storage operations on
+// the request path.
+type instrumentedStorage struct {
+	urlStorage
+}
+
+func (s instrumentedStorage) Save(rec *models.URLRecord) error {
+	defer metrics.ObserveStorage("save", time.Now())
+	return s.urlStorage.Save(rec)
+}
+
+func (s instrumentedStorage) SaveBatch(recs []*models.URLRecord) error {
+	defer metrics.ObserveStorage("save_batch", time.Now())
+	return s.urlStorage.SaveBatch(recs)
+}
+
+func (s instrumentedStorage) Get(hash string) (*models.URLRecord, error) {
+	defer metrics.ObserveStorage("get", time.Now())
+	return s.urlStorage.Get(hash)
+}
+
+func newFileStorage(options *config.Options) (*storage.FileStorage, error) {
+	policy, err := storage.ParseSyncPolicy(options.FileSync)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewFileStorage(options.StoragePath,
+		storage.WithSyncPolicy(policy),
+		storage.WithCompactThreshold(options.FileCompactThreshold),
+	)
+}
+
+// compactFileStorage is run as "shortener compact" while the server is
+// stopped, the running server compacts its file on its own. It refuses to
+// run while the server holds the storage lock.
+func compactFileStorage(options *config.Options) error {
+	if options.DatabaseDSN != "" || options.StoragePath == "" {
+		return errors.New("compact needs a file storage")
+	}
+
+	store, err := newFileStorage(options)
+	if err != nil {
+		return err
+	}
+	return errors.Join(store.Compact(), store.Close())
+}
+
+func serverHandler(services *service.Service, authenticator *auth.Authenticator) http.Handler {
 	router := chi.NewRouter()
-	router.Use(logger.RequestLoggerMiddleware)
+	router.Use(logger.RequestLogger(metrics.ObserveRequest))
 	router.Use(zipper.GzipMiddleware)
 
-	router.Post("/api/shorten", services.CreateShortedURLfromJSONHandler)
-	router.Post("/", services.CreateShortedURLHandler)
-	router.Get("/{id}", services.GetURLByHashHandler)
+	// probes, scrapes and internal calls get no auth cookies
+	router.Handle("/metrics", metrics.Handler())
+	router.Get("/ping", services.PingHandler)
+	router.Get("/healthz", services.HealthzHandler)
+	router.Get("/readyz", services.ReadyzHandler)
+	router.With(services.TrustedSubnetMiddleware).Get("/api/internal/stats", services.GetInternalStatsHandler)
+	// cacheable images and redirects must not carry auth cookies
+	router.With(services.RedirectRateLimitMiddleware).Get("/{id}/qr", services.GetQRCodeHandler)
+	router.With(services.RedirectRateLimitMiddleware).Get("/{id}", services.GetURLByHashHandler)
+	router.With(services.RedirectRateLimitMiddleware).Get("/{id}+", services.GetPreviewHandler)
+	router.Get("/api/urls/{id}", services.GetURLHandler)
+
+	router.Group(func(router chi.Router) {
+		router.Use(authenticator.Middleware)
+
+		router.Group(func(router chi.Router) {
+			router.Use(auth.RequireScope(auth.ScopeShorten))
+			router.Use(services.CreateRateLimitMiddleware)
+
+			router.Post("/api/shorten", services.CreateShortedURLfromJSONHandler)
+			router.Post("/api/shorten/batch", services.CreateShortedURLBatchHandler)
+			router.Post("/", services.CreateShortedURLHandler)
+		})
+		// the create limit charges the new cookies on its own
+		router.Group(func(router chi.Router) {
+			router.Use(services.IssueRateLimitMiddleware)
+
+			router.With(auth.RequireUser).Get("/api/user/urls", services.GetUserURLsHandler)
+			router.With(auth.RequireUser, auth.RequireScope(auth.ScopeDelete)).Delete("/api/user/urls", services.DeleteUserURLsHandler)
+			router.With(auth.RequireScope(auth.ScopeStats)).Get("/api/urls/{id}/stats", services.GetURLStatsHandler)
+		})
+	})
 
 	return router
 }
 
+const certCheckInterval = 10 * time.Second
+
+// newTLSConfig serves the certificate files or, without them, a
+// self-signed certificate for the configured hosts. The reloader is nil
+// for the self-signed certificate.
+func newTLSConfig(options *config.Options) (*tls.Config, *certs.Reloader, error) {
+	if options.TLSCertFile != "" {
+		reloader, err := certs.NewReloader(options.TLSCertFile, options.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}, reloader, nil
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(options.PrivateHost); err == nil {
+		hosts = append(hosts, host)
+	}
+	if u, err := url.Parse(options.PublicHost); err == nil {
+		hosts = append(hosts, u.Hostname())
+	}
+
+	cert, err := certs.SelfSigned(hosts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Log.Warn("no certificate files configured, serving a self-signed certificate")
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*cert}}, nil, nil
+}
+
+// warnUntrustedProxies points out that behind a proxy the trusted subnet
+// sees the proxy address unless the proxy is trusted to set X-Real-IP.
+func warnUntrustedProxies(options *config.Options) {
+	if options.TrustedSubnet != "" && len(options.TrustedProxies) == 0 {
+		logger.Log.Warn("trusted subnet set without trusted proxies, X-Real-IP is ignored and the connection address is checked",
+			zap.String("subnet", options.TrustedSubnet))
+	}
+}
+
+// reload reads the configuration again and applies its reloadable part,
+// the current options stay in effect if the new ones are invalid.
+func reload(current *config.Options, services *service.Service) *config.Options {
+	var next config.Options
+	if err := config.Reparse(&next); err != nil {
+		logger.Log.Error("failed to reload configuration", zap.Error(err))
+		return current
+	}
+
+	// the generated key must outlive the reload
+	if next.SecretKey == "" {
+		next.SecretKey = current.SecretKey
+	}
+
+	applied, ignored := current.Reload(&next)
+	if len(ignored) > 0 {
+		logger.Log.Warn("options changed but take a restart to apply", zap.Strings("options", ignored))
+	}
+
+	if err := services.Reload(applied); err != nil {
+		logger.Log.Error("failed to reload configuration", zap.Error(err))
+		return current
+	}
+	if err := logger.SetLevel(applied.LogLevel); err != nil {
+		logger.Log.Error("failed to apply log level", zap.String("level", applied.LogLevel), zap.Error(err))
+	}
+
+	warnUntrustedProxies(applied)
+	logger.Log.Info("configuration reloaded")
+	return applied
+}
+
 func main() {
 	var options config.Options
-	config.ParseOptions(&options)
-	logger.Initialize(options.LogLevel)
+	if err := config.ParseOptions(&options); err != nil {
+		log.Fatal(err)
+	}
+
+	if options.PrintConfig {
+		if err := options.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := logger.Initialize(options.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "compact":
+		if err := compactFileStorage(&options); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "keys":
+		if err := manageKeys(&options, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	fstorage, err := storage.NewFileStorage(options.StoragePath)
+	store, err := newStorage(&options)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer fstorage.Close()
+	defer store.Close()
 
-	services := service.NewService(&options, fstorage, fstorage)
+	metrics.RegisterStoredLinks(func() (int, error) {
+		return store.CountURLs(context.Background())
+	})
+	instrumented := instrumentedStorage{store}
+
+	services := service.NewService(&options, instrumented, instrumented)
+	defer services.Close()
+	// loads the blocklist
+	if err := services.Reload(&options); err != nil {
+		log.Fatal(err)
+	}
+	services.IDGenerator, err = hasher.NewIDGenerator(options.IDGenerator)
+	if err != nil {
+		log.Fatal(err)
+	}
+	services.VisitorSalt, err = store.VisitorSalt()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	server := &http.Server{Addr: options.PrivateHost, Handler: serverHandler(services)}
+	if options.SecretKey == "" {
+		options.SecretKey, err = auth.NewSecretKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Log.Warn("no secret key configured, auth cookies will not survive a restart")
+	}
+	warnUntrustedProxies(&options)
+	authenticator := auth.NewAuthenticator(options.SecretKey, auth.WithKeyStore(store))
 
 	serverCtx, serverStopCtx := context.WithCancel(context.Background())
 
+	server := &http.Server{Addr: options.PrivateHost, Handler: serverHandler(services, authenticator)}
+
+	var grpcOptions []grpc.ServerOption
+	if options.EnableHTTPS {
+		tlsConfig, reloader, err := newTLSConfig(&options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if reloader != nil {
+			go reloader.Run(serverCtx, certCheckInterval)
+		}
+		server.TLSConfig = tlsConfig
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	grpcServer := grpcserver.NewServer(services, authenticator, grpcOptions...)
+	if options.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", options.GRPCAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go storage.RunReaper(serverCtx, store, options.ReapInterval)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		current := &options
+		for range hup {
+			current = reload(current, services)
+		}
+	}()
+
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		<-sig
 
+		// let load balancers notice the instance is not ready and drain it
+		services.SetReady(false)
+		time.Sleep(options.ShutdownDelay)
+
 		shutdownCtx, cancelFunc := context.WithTimeout(serverCtx, 30*time.Second)
 		defer cancelFunc()
 
@@ -66,10 +341,15 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		grpcServer.GracefulStop()
 		serverStopCtx()
 	}()
 
-	err = server.ListenAndServe()
+	if options.EnableHTTPS {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
@@ -4,14 +4,23 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image/png"
 	"io"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/n1l/url-shortener/internal/auth"
 	"github.com/n1l/url-shortener/internal/config"
 	"github.com/n1l/url-shortener/internal/hasher"
 	"github.com/n1l/url-shortener/internal/models"
@@ -172,7 +181,7 @@ func TestCreateShortedUrl(t *testing.T) {
 			method:       http.MethodPost,
 			body:         "http://eynt73dlmnjj3b.biz/t0pwb",
 			expectedCode: http.StatusCreated,
-			expectedBody: "http://example.com/HppQetTZ",
+			expectedBody: "http://example.com/HppQe_tT",
 		},
 	}
 
@@ -241,7 +250,13 @@ func TestCreateShortedUrlJSON(t *testing.T) {
 			method:       http.MethodPost,
 			body:         `{ "url" : "http://eynt73dlmnjj3b.biz/t0pwb" }`,
 			expectedCode: http.StatusCreated,
-			expectedBody: `{ "result" : "http://example.com/HppQetTZ" }`,
+			expectedBody: `{ "result" : "http://example.com/HppQe_tT" }`,
+		},
+		{
+			method:       http.MethodPost,
+			body:         `{ "url" : `,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{ "error" : "malformed JSON: unexpected EOF", "reason" : "invalid_request" }`,
 		},
 	}
 
@@ -267,19 +282,24 @@ func TestGzipCompression(t *testing.T) {
 		PublicHost: "http://example.com",
 	}
 
-	storage := storage.NewInMemoryStorage()
-	services := service.NewService(&options, storage, storage)
+	// every subtest gets its own storage, the same URL would conflict otherwise
+	newServer := func() *httptest.Server {
+		storage := storage.NewInMemoryStorage()
+		services := service.NewService(&options, storage, storage)
 
-	handler := http.HandlerFunc(services.CreateShortedURLfromJSONHandler)
+		handler := http.HandlerFunc(services.CreateShortedURLfromJSONHandler)
 
-	srv := httptest.NewServer(zipper.GzipMiddleware(handler))
-	defer srv.Close()
+		return httptest.NewServer(zipper.GzipMiddleware(handler))
+	}
 
 	requestBody := `{ "url" : "http://google.com" }`
 
 	successBody := `{ "result" : "http://example.com/x7kg9X5V" }`
 
 	t.Run("sends_gzip", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+
 		buf := bytes.NewBuffer(nil)
 		zb := gzip.NewWriter(buf)
 		_, err := zb.Write([]byte(requestBody))
@@ -303,6 +323,9 @@ func TestGzipCompression(t *testing.T) {
 	})
 
 	t.Run("accepts_gzip", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+
 		buf := bytes.NewBufferString(requestBody)
 		r := httptest.NewRequest("POST", srv.URL, buf)
 		r.RequestURI = ""
@@ -311,6 +334,7 @@ func TestGzipCompression(t *testing.T) {
 		resp, err := http.DefaultClient.Do(r)
 		require.NoError(t, err)
 		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"), "кэш должен различать сжатые ответы")
 
 		defer resp.Body.Close()
 
@@ -323,3 +347,1617 @@ func TestGzipCompression(t *testing.T) {
 		require.JSONEq(t, successBody, string(b))
 	})
 }
+
+func TestCreateShortedURLBatch(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	testCases := []struct {
+		name         string
+		method       string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "wrong_method",
+			method:       http.MethodGet,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "empty_batch",
+			method:       http.MethodPost,
+			body:         `[]`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid_url",
+			method:       http.MethodPost,
+			body:         `[{ "correlation_id" : "1", "original_url" : "not a url" }]`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:   "success",
+			method: http.MethodPost,
+			body: `[
+				{ "correlation_id" : "1", "original_url" : "http://google.com" },
+				{ "correlation_id" : "2", "original_url" : "http://eynt73dlmnjj3b.biz/t0pwb" }
+			]`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `[
+				{ "correlation_id" : "1", "short_url" : "http://example.com/x7kg9X5V" },
+				{ "correlation_id" : "2", "short_url" : "http://example.com/HppQe_tT" }
+			]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := strings.NewReader(tc.body)
+			r := httptest.NewRequest(tc.method, "/api/shorten/batch", body)
+			w := httptest.NewRecorder()
+
+			services.CreateShortedURLBatchHandler(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code, "Код ответа не совпадает с ожидаемым")
+			if tc.expectedBody != "" {
+				bodyStr := w.Body.String()
+				assert.JSONEq(t, tc.expectedBody, bodyStr, "Тело ответа не совпадает с ожидаемым"+" "+bodyStr)
+			}
+		})
+	}
+}
+
+func TestFileStorageSaveBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+
+	err = fstorage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"},
+		{ShortURL: "HppQe_tT", OriginalURL: "http://eynt73dlmnjj3b.biz/t0pwb"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, fstorage.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	rec, err := fstorage.Get("HppQe_tT")
+	require.NoError(t, err)
+	assert.Equal(t, "http://eynt73dlmnjj3b.biz/t0pwb", rec.OriginalURL)
+}
+
+func TestCreateShortedURLConflict(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	t.Run("plain", func(t *testing.T) {
+		for _, expectedCode := range []int{http.StatusCreated, http.StatusConflict} {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("http://google.com"))
+			w := httptest.NewRecorder()
+
+			services.CreateShortedURLHandler(w, r)
+
+			assert.Equal(t, expectedCode, w.Code, "Код ответа не совпадает с ожидаемым")
+			assert.Equal(t, "http://example.com/x7kg9X5V", w.Body.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{ "url" : "http://google.com" }`))
+		w := httptest.NewRecorder()
+
+		services.CreateShortedURLfromJSONHandler(w, r)
+
+		assert.Equal(t, http.StatusConflict, w.Code, "Код ответа не совпадает с ожидаемым")
+		assert.JSONEq(t, `{ "result" : "http://example.com/x7kg9X5V" }`, w.Body.String())
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		body := `[
+			{ "correlation_id" : "1", "original_url" : "http://google.com" },
+			{ "correlation_id" : "2", "original_url" : "http://google.com" }
+		]`
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		services.CreateShortedURLBatchHandler(w, r)
+
+		assert.Equal(t, http.StatusCreated, w.Code, "Код ответа не совпадает с ожидаемым")
+		assert.JSONEq(t, `[
+			{ "correlation_id" : "1", "short_url" : "http://example.com/x7kg9X5V" },
+			{ "correlation_id" : "2", "short_url" : "http://example.com/x7kg9X5V" }
+		]`, w.Body.String())
+	})
+}
+
+// prefixGenerator returns the same ID for every URL until the collision
+// makes the service ask for a longer one.
+type prefixGenerator struct{}
+
+func (prefixGenerator) Generate(_ string, length int, attempt int) string {
+	return strings.Repeat("a", length) + strings.Repeat("b", attempt)
+}
+
+func TestCreateShortedURLCollision(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+		IDLength:   4,
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	services.IDGenerator = prefixGenerator{}
+
+	expected := []string{
+		"http://example.com/aaaa",
+		"http://example.com/aaaab",
+		"http://example.com/aaaabb",
+	}
+	for i, expectedBody := range expected {
+		body := strings.NewReader(fmt.Sprintf("http://google.com/%d", i))
+		r := httptest.NewRequest(http.MethodPost, "/", body)
+		w := httptest.NewRecorder()
+
+		services.CreateShortedURLHandler(w, r)
+
+		assert.Equal(t, http.StatusCreated, w.Code, "Код ответа не совпадает с ожидаемым")
+		assert.Equal(t, expectedBody, w.Body.String())
+	}
+
+	rec, err := storage.Get("aaaa")
+	require.NoError(t, err)
+	assert.Equal(t, "http://google.com/0", rec.OriginalURL)
+}
+
+func TestGetUserURLs(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	srv := httptest.NewServer(serverHandler(services, auth.NewAuthenticator("secret")))
+	defer srv.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+
+	t.Run("no_urls", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/api/user/urls")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("own_urls", func(t *testing.T) {
+		resp, err := client.Post(srv.URL+"/", "text/plain", strings.NewReader("http://google.com"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp, err = client.Get(srv.URL + "/api/user/urls")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `[{ "short_url" : "http://example.com/x7kg9X5V", "original_url" : "http://google.com" }]`, string(b))
+	})
+
+	t.Run("other_user", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/api/user/urls")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("invalid_cookie", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, srv.URL+"/api/user/urls", nil)
+		require.NoError(t, err)
+		r.AddCookie(&http.Cookie{Name: auth.CookieName, Value: "someone.0badc0de"})
+
+		resp, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestDeleteUserURLs(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	srv := httptest.NewServer(serverHandler(services, auth.NewAuthenticator("secret")))
+	defer srv.Close()
+
+	newClient := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		return &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	owner, stranger := newClient(), newClient()
+
+	for _, url := range []string{"http://google.com", "http://eynt73dlmnjj3b.biz/t0pwb"} {
+		resp, err := owner.Post(srv.URL+"/", "text/plain", strings.NewReader(url))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	deleteURLs := func(client *http.Client, body string) {
+		r, err := http.NewRequest(http.MethodDelete, srv.URL+"/api/user/urls", strings.NewReader(body))
+		require.NoError(t, err)
+
+		resp, err := client.Do(r)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	deleteURLs(stranger, `["HppQe_tT"]`)
+	deleteURLs(owner, `["x7kg9X5V"]`)
+
+	// flushes the pending deletions
+	require.NoError(t, services.Close())
+
+	testCases := []struct {
+		id           string
+		expectedCode int
+	}{
+		{id: "x7kg9X5V", expectedCode: http.StatusGone},
+		{id: "HppQe_tT", expectedCode: http.StatusTemporaryRedirect},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.id, func(t *testing.T) {
+			resp, err := owner.Get(srv.URL + "/" + tc.id)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestFileStorageMarkDeleted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+
+	rec := &models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com", UserID: "owner"}
+	require.NoError(t, fstorage.Save(rec))
+	require.NoError(t, fstorage.MarkDeleted([]models.DeletionRequest{{UserID: "owner", ShortURL: "x7kg9X5V"}}))
+	require.NoError(t, fstorage.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+
+	rec, err = fstorage.Get("x7kg9X5V")
+	require.NoError(t, err)
+	assert.True(t, rec.DeletedFlag)
+
+	// shortening a deleted URL again gives it a new id, the old one stays deleted
+	err = fstorage.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com", UserID: "another"})
+	var takenErr *storage.IDTakenError
+	require.ErrorAs(t, err, &takenErr, "id удалённой ссылки не выдаётся повторно")
+
+	rec = &models.URLRecord{ShortURL: "other", OriginalURL: "http://google.com", UserID: "another"}
+	require.NoError(t, fstorage.Save(rec))
+	assert.Equal(t, "other", rec.ShortURL)
+	require.NoError(t, fstorage.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	rec, err = fstorage.Get("x7kg9X5V")
+	require.NoError(t, err)
+	assert.True(t, rec.DeletedFlag)
+	assert.Equal(t, "owner", rec.UserID)
+
+	rec, err = fstorage.Get("other")
+	require.NoError(t, err)
+	assert.False(t, rec.DeletedFlag)
+	assert.Equal(t, "another", rec.UserID)
+
+	var existsErr *storage.AlreadyExistsError
+	require.ErrorAs(t, fstorage.Save(&models.URLRecord{ShortURL: "third", OriginalURL: "http://google.com"}), &existsErr)
+	assert.Equal(t, "other", existsErr.Existing.ShortURL)
+}
+
+func TestCreateShortedURLWithAlias(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	require.NoError(t, storage.Save(&models.URLRecord{ShortURL: "winter-old", OriginalURL: "http://google.com/winter", DeletedFlag: true}))
+
+	testCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "success",
+			body:         `{ "url" : "http://google.com/spring", "alias" : "spring-sale" }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{ "result" : "http://example.com/spring-sale" }`,
+		},
+		{
+			name:         "same_url",
+			body:         `{ "url" : "http://google.com/spring", "alias" : "spring-sale" }`,
+			expectedCode: http.StatusConflict,
+			expectedBody: `{ "result" : "http://example.com/spring-sale" }`,
+		},
+		{
+			name:         "taken",
+			body:         `{ "url" : "http://google.com/autumn", "alias" : "spring-sale" }`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "other_alias_for_same_url",
+			body:         `{ "url" : "http://google.com/spring", "alias" : "spring-promo" }`,
+			expectedCode: http.StatusConflict,
+			expectedBody: `{ "result" : "http://example.com/spring-sale" }`,
+		},
+		{
+			name:         "deleted_url",
+			body:         `{ "url" : "http://google.com/winter", "alias" : "winter-sale" }`,
+			expectedCode: http.StatusCreated,
+			expectedBody: `{ "result" : "http://example.com/winter-sale" }`,
+		},
+		{
+			name:         "deleted_id",
+			body:         `{ "url" : "http://google.com/autumn", "alias" : "winter-old" }`,
+			expectedCode: http.StatusConflict,
+		},
+		{
+			name:         "too_short",
+			body:         `{ "url" : "http://google.com/autumn", "alias" : "ab" }`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "forbidden_characters",
+			body:         `{ "url" : "http://google.com/autumn", "alias" : "autumn/sale" }`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "reserved",
+			body:         `{ "url" : "http://google.com/autumn", "alias" : "API" }`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+
+			services.CreateShortedURLfromJSONHandler(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code, "Код ответа не совпадает с ожидаемым")
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestExpiringURLs(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	createTestCases := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "ttl",
+			body:         `{ "url" : "http://google.com/ttl", "ttl_seconds" : 3600 }`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "expires_at",
+			body:         `{ "url" : "http://google.com/expires", "expires_at" : "2999-01-01T00:00:00Z" }`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "both",
+			body:         `{ "url" : "http://google.com/both", "ttl_seconds" : 60, "expires_at" : "2999-01-01T00:00:00Z" }`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "negative_ttl",
+			body:         `{ "url" : "http://google.com/negative", "ttl_seconds" : -1 }`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "past",
+			body:         `{ "url" : "http://google.com/past", "expires_at" : "2000-01-01T00:00:00Z" }`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range createTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+
+			services.CreateShortedURLfromJSONHandler(w, r)
+
+			assert.Equal(t, tc.expectedCode, w.Code, "Код ответа не совпадает с ожидаемым")
+		})
+	}
+
+	rec, err := storage.Get(hasher.GetHashOfURL("http://google.com/expires"))
+	require.NoError(t, err)
+	require.NotNil(t, rec.ExpiresAt)
+	assert.Equal(t, 2999, rec.ExpiresAt.Year())
+
+	t.Run("expired", func(t *testing.T) {
+		expiresAt := time.Now().Add(-time.Minute)
+		require.NoError(t, storage.Save(&models.URLRecord{
+			ShortURL:    "expired",
+			OriginalURL: "http://google.com/expired",
+			ExpiresAt:   &expiresAt,
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/expired", nil)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", "expired")
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+		services.GetURLByHashHandler(w, r)
+
+		assert.Equal(t, http.StatusGone, w.Code, "Код ответа не совпадает с ожидаемым")
+
+		rec, err := services.Shorten("another", &models.CreateShortenRequest{URL: "http://google.com/expired"})
+		require.NoError(t, err)
+		assert.NotEqual(t, "expired", rec.ShortURL, "истёкший id не выдаётся повторно")
+
+		old, err := storage.Get("expired")
+		require.NoError(t, err)
+		assert.True(t, old.Expired(time.Now()))
+		assert.Empty(t, old.UserID)
+	})
+
+	t.Run("not_listed", func(t *testing.T) {
+		expiresAt := time.Now().Add(-time.Minute)
+		require.NoError(t, storage.SaveBatch([]*models.URLRecord{
+			{ShortURL: "gone1", OriginalURL: "http://google.com/gone", UserID: "owner", ExpiresAt: &expiresAt},
+			{ShortURL: "alive1", OriginalURL: "http://google.com/alive", UserID: "owner"},
+		}))
+
+		urls, err := services.UserURLs("owner")
+		require.NoError(t, err)
+		require.Len(t, urls, 1, "истёкшие ссылки не показываются до очистки")
+		assert.Equal(t, "http://example.com/alive1", urls[0].ShortURL)
+	})
+}
+
+func TestFileStoragePurgeExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+
+	now := time.Now()
+	expired, alive := now.Add(-time.Minute), now.Add(time.Hour)
+	require.NoError(t, fstorage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "expired", OriginalURL: "http://google.com/expired", ExpiresAt: &expired},
+		{ShortURL: "alive", OriginalURL: "http://google.com/alive", ExpiresAt: &alive},
+		{ShortURL: "forever", OriginalURL: "http://google.com/forever"},
+	}))
+
+	purged, err := fstorage.PurgeExpired(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	// the storage keeps appending to the compacted file
+	require.NoError(t, fstorage.Save(&models.URLRecord{ShortURL: "fresh", OriginalURL: "http://google.com/fresh"}))
+	require.NoError(t, fstorage.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "\n"))
+	assert.NotContains(t, string(data), "http://google.com/expired")
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	rec, err := fstorage.Get("expired")
+	require.NoError(t, err, "от очищенной ссылки остаётся надгробие")
+	assert.True(t, rec.DeletedFlag)
+	assert.Empty(t, rec.OriginalURL)
+	_, err = fstorage.Get("fresh")
+	assert.NoError(t, err)
+
+	// the purged id is not handed out again, the URL gets a new one
+	err = fstorage.Save(&models.URLRecord{ShortURL: "expired", OriginalURL: "http://google.com/other"})
+	var takenErr *storage.IDTakenError
+	require.ErrorAs(t, err, &takenErr, "id очищенной ссылки не выдаётся повторно")
+
+	rec = &models.URLRecord{ShortURL: "again", OriginalURL: "http://google.com/expired"}
+	require.NoError(t, fstorage.Save(rec))
+	assert.Equal(t, "again", rec.ShortURL)
+
+	purged, err = fstorage.PurgeExpired(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged, "надгробия повторно не очищаются")
+}
+
+func TestGetURLStats(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	require.NoError(t, storage.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com", UserID: "alice"}))
+
+	authenticator := auth.NewAuthenticator("secret")
+	router := serverHandler(services, authenticator)
+
+	getStats := func(id, userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/urls/"+id+"/stats", nil)
+		if userID != "" {
+			r.AddCookie(&http.Cookie{Name: auth.CookieName, Value: authenticator.Sign(userID)})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"} {
+		r := httptest.NewRequest(http.MethodGet, "/x7kg9X5V", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	}
+
+	// flushes the recorded clicks
+	require.NoError(t, services.Close())
+
+	t.Run("known", func(t *testing.T) {
+		w := getStats("x7kg9X5V", "alice")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var stats models.LinkStats
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		assert.Equal(t, 3, stats.TotalClicks)
+		assert.Equal(t, 2, stats.UniqueVisitors)
+		require.Len(t, stats.Daily, 1)
+		assert.Equal(t, time.Now().UTC().Format("2006-01-02"), stats.Daily[0].Date)
+		assert.Equal(t, 3, stats.Daily[0].Clicks)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, getStats("unknown", "alice").Code)
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, getStats("x7kg9X5V", "bob").Code, "статистика чужой ссылки не видна")
+		assert.Equal(t, http.StatusNotFound, getStats("x7kg9X5V", "").Code, "и новому пользователю тоже")
+	})
+}
+
+func TestGetURL(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+
+	require.NoError(t, storage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "guarded1", OriginalURL: "http://google.com", Interstitial: true},
+		{ShortURL: "deleted1", OriginalURL: "http://go.dev", DeletedFlag: true},
+	}))
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/api/urls/guarded1")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"short_url": "http://example.com/guarded1", "original_url": "http://google.com"}`, w.Body.String())
+	assert.Empty(t, w.Header().Values("Set-Cookie"))
+
+	assert.Equal(t, http.StatusNotFound, get("/api/urls/missing").Code)
+	assert.Equal(t, http.StatusGone, get("/api/urls/deleted1").Code)
+
+	// flushes the recorded clicks
+	require.NoError(t, services.Close())
+	stats, err := storage.GetClickStats("guarded1")
+	require.NoError(t, err)
+	assert.Zero(t, stats.TotalClicks, "запрос адреса не считается переходом")
+}
+
+// unavailableStorage fails every lookup like a database that is down.
+type unavailableStorage struct {
+	*storage.InMemoryStorage
+}
+
+func (unavailableStorage) Get(string) (*models.URLRecord, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := unavailableStorage{storage.NewInMemoryStorage()}
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+	for _, target := range []string{"/x7kg9X5V", "/x7kg9X5V+", "/x7kg9X5V/qr", "/api/urls/x7kg9X5V", "/api/urls/x7kg9X5V/stats"} {
+		t.Run(target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code, "сбой хранилища не выдаётся за неизвестную ссылку")
+		})
+	}
+}
+
+func TestFileStorageClicks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+
+	require.NoError(t, fstorage.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"}))
+	require.NoError(t, fstorage.SaveClicks([]models.Click{
+		{ShortURL: "x7kg9X5V", Time: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), VisitorHash: "a"},
+		{ShortURL: "x7kg9X5V", Time: time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC), VisitorHash: "a"},
+	}))
+	require.NoError(t, fstorage.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	stats, err := fstorage.GetClickStats("x7kg9X5V")
+	require.NoError(t, err)
+	assert.Equal(t, &models.LinkStats{
+		ShortURL:       "x7kg9X5V",
+		TotalClicks:    2,
+		UniqueVisitors: 1,
+		Daily: []models.DailyClicks{
+			{Date: "2024-03-01", Clicks: 1},
+			{Date: "2024-03-02", Clicks: 1},
+		},
+	}, stats)
+}
+
+func TestFileStorageClicksCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	expiresAt := time.Now().Add(-time.Minute)
+	require.NoError(t, fstorage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "expired", OriginalURL: "http://google.com/expired", ExpiresAt: &expiresAt},
+		{ShortURL: "forever", OriginalURL: "http://google.com/forever"},
+	}))
+	require.NoError(t, fstorage.SaveClicks([]models.Click{
+		{ShortURL: "expired", Time: time.Now(), VisitorHash: "a"},
+		{ShortURL: "forever", Time: time.Now(), VisitorHash: "a"},
+	}))
+
+	purged, err := fstorage.PurgeExpired(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	data, err := os.ReadFile(path + ".clicks")
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"), "переходы удалённых ссылок вычищаются")
+	assert.NotContains(t, string(data), `"expired"`)
+
+	// the storage keeps appending to the compacted clicks file
+	require.NoError(t, fstorage.SaveClicks([]models.Click{{ShortURL: "forever", Time: time.Now(), VisitorHash: "b"}}))
+	data, err = os.ReadFile(path + ".clicks")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+}
+
+func TestVisitorSalt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	salt, err := fstorage.VisitorSalt()
+	require.NoError(t, err)
+	require.NotEmpty(t, salt)
+	require.NoError(t, fstorage.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	again, err := fstorage.VisitorSalt()
+	require.NoError(t, err)
+	assert.Equal(t, salt, again, "соль переживает перезапуск")
+
+	other, err := storage.NewInMemoryStorage().VisitorSalt()
+	require.NoError(t, err)
+	assert.NotEqual(t, salt, other)
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, fstorage.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"}))
+	require.NoError(t, fstorage.Close())
+
+	// a crash in the middle of a write leaves a line without a newline
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"short_url":"torn","original_url":"http://goo`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err, "хранилище должно открываться после обрыва записи")
+
+	_, err = fstorage.Get("x7kg9X5V")
+	assert.NoError(t, err)
+	_, err = fstorage.Get("torn")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	require.NoError(t, fstorage.Save(&models.URLRecord{ShortURL: "fresh", OriginalURL: "http://google.com/fresh"}))
+	require.NoError(t, fstorage.Close())
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	_, err = fstorage.Get("fresh")
+	assert.NoError(t, err)
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+
+	// a temp file left by a crash in the middle of a compaction
+	require.NoError(t, os.WriteFile(path+".123.tmp", []byte("garbage"), 0666))
+
+	fstorage, err := storage.NewFileStorage(path, storage.WithSyncPolicy(storage.SyncAlways), storage.WithCompactThreshold(1))
+	require.NoError(t, err)
+
+	_, err = os.Stat(path + ".123.tmp")
+	assert.True(t, os.IsNotExist(err), "временный файл должен быть удалён")
+
+	require.NoError(t, fstorage.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com", UserID: "user"}))
+	require.NoError(t, fstorage.MarkDeleted([]models.DeletionRequest{{UserID: "user", ShortURL: "x7kg9X5V"}}))
+	require.NoError(t, fstorage.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"), "файл должен сжиматься")
+
+	fstorage, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	rec, err := fstorage.Get("x7kg9X5V")
+	require.NoError(t, err)
+	assert.True(t, rec.DeletedFlag)
+
+	require.NoError(t, fstorage.Compact())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+}
+
+func TestFileStorageLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	server, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, server.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"}))
+
+	_, err = storage.NewFileStorage(path)
+	assert.ErrorIs(t, err, storage.ErrLocked, "второй процесс не открывает занятое хранилище")
+
+	err = compactFileStorage(&config.Options{StoragePath: path})
+	assert.ErrorIs(t, err, storage.ErrLocked, "сжатие не запускается при работающем сервере")
+
+	_, err = server.Get("x7kg9X5V")
+	assert.NoError(t, err)
+	require.NoError(t, server.Close())
+
+	require.NoError(t, compactFileStorage(&config.Options{StoragePath: path}), "после остановки сервера сжатие работает")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	path := filepath.Join(t.TempDir(), "storage.json")
+	fstorage, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer fstorage.Close()
+
+	services := service.NewService(&options, fstorage, fstorage)
+	defer services.Close()
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+
+	probe := func(target string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	for _, target := range []string{"/ping", "/healthz", "/readyz"} {
+		res := probe(target)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, target)
+		assert.Empty(t, res.Cookies(), "пробы не должны получать куки")
+	}
+
+	services.SetReady(false)
+
+	res := probe("/readyz")
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "при остановке сервис не готов")
+
+	res = probe("/healthz")
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "при остановке сервис жив")
+
+	services.SetReady(true)
+	require.NoError(t, os.Remove(path))
+
+	res = probe("/ping")
+	res.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode, "файл хранилища недоступен")
+
+	res = probe("/readyz")
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestMetrics(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	require.NoError(t, storage.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"}))
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+
+	for _, target := range []string{"/x7kg9X5V", "/unknown"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `shortener_http_requests_total{method="GET",route="/{id}",status="307"}`)
+	assert.Contains(t, body, `shortener_http_request_duration_seconds_bucket{method="GET",route="/{id}",status="400"`)
+	assert.Contains(t, body, `shortener_redirects_total{result="served"}`)
+	assert.Contains(t, body, `shortener_redirects_total{result="not_found"}`)
+}
+
+func TestInternalStats(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	// the retired links are not counted as stored
+	expired := time.Now().Add(-time.Hour)
+	require.NoError(t, storage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "a", OriginalURL: "http://google.com/a", UserID: "alice"},
+		{ShortURL: "b", OriginalURL: "http://google.com/b", UserID: "alice"},
+		{ShortURL: "c", OriginalURL: "http://google.com/c", UserID: "bob"},
+		{ShortURL: "d", OriginalURL: "http://google.com/d", UserID: "bob", DeletedFlag: true},
+		{ShortURL: "e", OriginalURL: "http://google.com/e", UserID: "bob", ExpiresAt: &expired},
+	}))
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+
+	get := func(realIP, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/internal/stats", nil)
+		if realIP != "" {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("10.0.0.1", "10.0.0.1:1234").Code, "без подсети эндпоинт выключен")
+
+	require.NoError(t, services.Reload(&config.Options{
+		PublicHost:     "http://example.com",
+		TrustedSubnet:  "10.0.0.0/24",
+		TrustedProxies: []string{"192.168.1.1/32"},
+	}))
+
+	tests := []struct {
+		name       string
+		realIP     string
+		remoteAddr string
+		status     int
+	}{
+		{name: "trusted header", realIP: "10.0.0.7", remoteAddr: "192.168.1.1:1234", status: http.StatusOK},
+		{name: "untrusted header", realIP: "10.0.1.7", remoteAddr: "192.168.1.1:1234", status: http.StatusForbidden},
+		{name: "spoofed header", realIP: "10.0.0.7", remoteAddr: "192.168.1.2:1234", status: http.StatusForbidden},
+		{name: "header ignored without proxy", realIP: "10.0.1.7", remoteAddr: "10.0.0.1:1234", status: http.StatusOK},
+		{name: "trusted remote address", remoteAddr: "10.0.0.9:1234", status: http.StatusOK},
+		{name: "untrusted remote address", remoteAddr: "192.168.1.1:1234", status: http.StatusForbidden},
+		{name: "garbage header", realIP: "not-an-ip", remoteAddr: "192.168.1.1:1234", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.realIP, tt.remoteAddr)
+			require.Equal(t, tt.status, w.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var stats models.InternalStats
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+			assert.Equal(t, models.InternalStats{URLs: 3, Users: 2}, stats)
+		})
+	}
+}
+
+func TestURLPolicy(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("# phishing\nevil.com\n*.bad.org\n"), 0666))
+
+	options := config.Options{
+		PublicHost:    "http://sho.rt",
+		BlocklistFile: blocklist,
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+	require.NoError(t, services.Reload(&options))
+
+	testCases := []struct {
+		name   string
+		url    string
+		reason string
+	}{
+		{name: "allowed", url: "http://good.com/page"},
+		{name: "javascript", url: "javascript:alert(1)", reason: service.ReasonSchemeNotAllowed},
+		{name: "ftp", url: "ftp://files.com/a", reason: service.ReasonSchemeNotAllowed},
+		{name: "relative", url: "/just/a/path", reason: service.ReasonSchemeNotAllowed},
+		{name: "no host", url: "http:///path", reason: service.ReasonInvalidURL},
+		{name: "blocked domain", url: "https://evil.com/login", reason: service.ReasonDomainBlocked},
+		{name: "blocked subdomain", url: "https://login.EVIL.com/", reason: service.ReasonDomainBlocked},
+		{name: "blocked suffix", url: "http://x.bad.org", reason: service.ReasonDomainBlocked},
+		{name: "similar domain", url: "http://notevil.com"},
+		{name: "self reference", url: "http://SHO.RT/x7kg9X5V", reason: service.ReasonSelfReference},
+		{name: "self reference default port", url: "http://sho.rt:80/abc", reason: service.ReasonSelfReference},
+		{name: "other port", url: "http://sho.rt:8081/abc"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{ "url" : %q }`, tc.url)
+			r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+			w := httptest.NewRecorder()
+
+			services.CreateShortedURLfromJSONHandler(w, r)
+
+			if tc.reason == "" {
+				assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+				return
+			}
+
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var resp models.ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tc.reason, resp.Reason)
+			assert.NotEmpty(t, resp.Error)
+		})
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		body := `[{"correlation_id": "1", "original_url": "http://good.com/1"}, {"correlation_id": "2", "original_url": "http://evil.com"}]`
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		services.CreateShortedURLBatchHandler(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		var resp models.ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, service.ReasonDomainBlocked, resp.Reason)
+		assert.Contains(t, resp.Error, "correlation_id: '2'")
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(blocklist, []byte("good.com\n"), 0666))
+		require.NoError(t, services.Reload(&options))
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("http://good.com/other"))
+		w := httptest.NewRecorder()
+		services.CreateShortedURLHandler(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "обновлённый список должен применяться")
+
+		require.NoError(t, os.Remove(blocklist))
+		assert.Error(t, services.Reload(&options), "без файла остаётся прежний список")
+
+		w = httptest.NewRecorder()
+		services.CreateShortedURLHandler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("http://good.com/other")))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	options := config.Options{
+		PublicHost:        "http://example.com",
+		CreateRateLimit:   0.001,
+		CreateRateBurst:   2,
+		RedirectRateLimit: 0.001,
+		RedirectRateBurst: 3,
+		RateLimitIdle:     time.Minute,
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	authenticator := auth.NewAuthenticator("secret")
+	router := serverHandler(services, authenticator)
+
+	create := func(ip string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("http://google.com"))
+		r.RemoteAddr = ip + ":1234"
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := create("10.0.0.1", nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("X-RateLimit-Reset"))
+
+	shortURL := w.Body.String()
+
+	require.Equal(t, http.StatusConflict, create("10.0.0.1", nil).Code, "ответ 409 тоже расходует токен")
+
+	w = create("10.0.0.1", nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code, "без cookie клиент определяется по адресу")
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1000", w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusConflict, create("10.0.0.2", nil).Code, "у другого адреса свой лимит")
+
+	cookie := &http.Cookie{Name: auth.CookieName, Value: authenticator.Sign("alice")}
+	assert.Equal(t, http.StatusConflict, create("10.0.0.1", cookie).Code, "пользователь с cookie лимитируется отдельно")
+
+	t.Run("issued cookies", func(t *testing.T) {
+		mint := func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+			r.RemoteAddr = "10.0.0.3:1234"
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w
+		}
+
+		for i := 0; i < 2; i++ {
+			w := mint()
+			require.Equal(t, http.StatusNoContent, w.Code)
+			require.NotEmpty(t, w.Result().Cookies())
+		}
+
+		w := mint()
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, "новые cookie расходуют лимит адреса")
+		assert.Empty(t, w.Result().Cookies())
+		assert.Equal(t, http.StatusTooManyRequests, create("10.0.0.3", nil).Code)
+	})
+
+	t.Run("spoofed header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("http://google.com"))
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Real-IP", "10.0.0.99")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, "X-Real-IP не от прокси не даёт нового лимита")
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		id := strings.TrimPrefix(shortURL, "http://example.com/")
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/"+id, nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			require.Equal(t, http.StatusTemporaryRedirect, w.Code, "у переходов отдельный лимит")
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/"+id, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		next := options
+		next.CreateRateLimit = 0
+		require.NoError(t, services.Reload(&next))
+
+		w := create("10.0.0.1", nil)
+		assert.Equal(t, http.StatusConflict, w.Code, "нулевой лимит отключает ограничение")
+		assert.Empty(t, w.Header().Get("X-RateLimit-Limit"))
+	})
+}
+
+func createTestKey(t *testing.T, keys auth.KeyStore, args ...string) (token, id string) {
+	t.Helper()
+
+	var out bytes.Buffer
+	require.NoError(t, runKeysCommand(keys, append([]string{"create"}, args...), &out))
+	for _, line := range strings.Split(out.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, "key:"); ok {
+			token = strings.TrimSpace(value)
+		}
+		if value, ok := strings.CutPrefix(line, "id:"); ok {
+			id = strings.TrimSpace(value)
+		}
+	}
+	require.NotEmpty(t, token)
+	return token, id
+}
+
+func TestAPIKeys(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	store := storage.NewInMemoryStorage()
+	services := service.NewService(&options, store, store)
+	defer services.Close()
+
+	router := serverHandler(services, auth.NewAuthenticator("secret", auth.WithKeyStore(store)))
+
+	shortenKey, _ := createTestKey(t, store, "-user", "jobs", "-name", "nightly import")
+	adminKey, adminID := createTestKey(t, store, "-user", "jobs", "-scopes", "shorten,delete,stats")
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/", "http://google.com", "Authorization", "Bearer "+shortenKey)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Empty(t, w.Header().Get("Set-Cookie"), "клиенту с ключом cookie не нужна")
+
+	w = do(http.MethodPost, "/api/shorten", `{"url": "http://ya.ru"}`, "X-API-Key", adminKey)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	recs, err := store.GetByUser("jobs")
+	require.NoError(t, err)
+	assert.Len(t, recs, 2, "ссылки принадлежат аккаунту ключа")
+
+	w = do(http.MethodGet, "/api/user/urls", "", "X-API-Key", shortenKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	testCases := []struct {
+		name   string
+		method string
+		target string
+		header []string
+		status int
+	}{
+		{name: "no delete scope", method: http.MethodDelete, target: "/api/user/urls", header: []string{"X-API-Key", shortenKey}, status: http.StatusForbidden},
+		{name: "no stats scope", method: http.MethodGet, target: "/api/urls/x7kg9X5V/stats", header: []string{"X-API-Key", shortenKey}, status: http.StatusForbidden},
+		{name: "stats scope", method: http.MethodGet, target: "/api/urls/x7kg9X5V/stats", header: []string{"X-API-Key", adminKey}, status: http.StatusOK},
+		{name: "wrong secret", method: http.MethodPost, target: "/", header: []string{"X-API-Key", adminID + ".00"}, status: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodPost, target: "/", header: []string{"Authorization", "Bearer garbage"}, status: http.StatusUnauthorized},
+		{name: "basic auth ignored", method: http.MethodPost, target: "/", header: []string{"Authorization", "Basic dXNlcjpwYXNz"}, status: http.StatusCreated},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `["x7kg9X5V"]`
+			if tc.method == http.MethodPost {
+				body = "http://example.org/" + strings.ReplaceAll(tc.name, " ", "-")
+			}
+			assert.Equal(t, tc.status, do(tc.method, tc.target, body, tc.header...).Code)
+		})
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, runKeysCommand(store, []string{"revoke", adminID}, &out))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/", "http://google.com", "X-API-Key", adminKey).Code, "отозванный ключ не принимается")
+
+	out.Reset()
+	require.NoError(t, runKeysCommand(store, []string{"list"}, &out))
+	assert.Contains(t, out.String(), "nightly import")
+	assert.Contains(t, out.String(), adminID)
+	assert.NotContains(t, out.String(), adminKey)
+
+	assert.Error(t, runKeysCommand(store, []string{"create", "-scopes", "admin"}, &out))
+	assert.ErrorIs(t, runKeysCommand(store, []string{"revoke", "missing"}, &out), storage.ErrAPIKeyNotFound)
+}
+
+func TestFileStorageAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	server, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer server.Close()
+	authenticator := auth.NewAuthenticator("secret", auth.WithKeyStore(server))
+
+	admin, err := storage.NewKeyFile(path)
+	require.NoError(t, err)
+	token, id := createTestKey(t, admin, "-user", "jobs")
+
+	key, err := authenticator.VerifyKey(token)
+	require.NoError(t, err, "ключ, созданный другим процессом, виден без перезапуска")
+	assert.Equal(t, "jobs", key.UserID)
+
+	require.NoError(t, runKeysCommand(admin, []string{"revoke", id}, io.Discard))
+	require.NoError(t, runKeysCommand(admin, []string{"revoke", id}, io.Discard), "повторный отзыв ничего не меняет")
+	assert.ErrorIs(t, runKeysCommand(admin, []string{"revoke", "missing"}, io.Discard), storage.ErrAPIKeyNotFound)
+	require.NoError(t, admin.Close())
+
+	_, err = authenticator.VerifyKey(token)
+	assert.ErrorIs(t, err, auth.ErrInvalidKey)
+
+	data, err := os.ReadFile(path + ".keys")
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"), "отозванный ключ не дописывается повторно")
+	assert.NotContains(t, string(data), strings.SplitN(token, ".", 2)[1], "секрет ключа не хранится")
+}
+
+func TestKeysCommandLeavesServerFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	// the server is writing a record and compacting at the same time
+	torn := `{"short_url":"x7kg9X5V","original_url":"http://goo`
+	require.NoError(t, os.WriteFile(path, []byte(torn), 0666))
+	require.NoError(t, os.WriteFile(path+".clicks", []byte(`{"short_url":"x7`), 0666))
+	require.NoError(t, os.WriteFile(path+".123.tmp", []byte("compacting"), 0666))
+	// and the keys file ends with a key still being written
+	require.NoError(t, os.WriteFile(path+".keys", []byte(`{"id":"half`), 0600))
+
+	options := &config.Options{StoragePath: path}
+	require.NoError(t, manageKeys(options, []string{"create", "-user", "jobs"}, io.Discard))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, torn, string(data), "файл записей не обрезается")
+	data, err = os.ReadFile(path + ".clicks")
+	require.NoError(t, err)
+	assert.Equal(t, `{"short_url":"x7`, string(data), "файл переходов не обрезается")
+	assert.FileExists(t, path+".123.tmp", "временный файл сервера не удаляется")
+
+	data, err = os.ReadFile(path + ".keys")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), `{"id":"half`+"\n"), "оборванная строка ключей не обрезается")
+
+	var out bytes.Buffer
+	require.NoError(t, manageKeys(options, []string{"list"}, &out))
+	assert.Contains(t, out.String(), "jobs", "новый ключ читается после оборванной строки")
+}
+
+func TestQRCode(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	expiresAt := time.Now().Add(time.Hour)
+	require.NoError(t, storage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"},
+		{ShortURL: "expiring", OriginalURL: "http://ya.ru", ExpiresAt: &expiresAt},
+		{ShortURL: "deleted1", OriginalURL: "http://go.dev", DeletedFlag: true},
+	}))
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/x7kg9X5V/qr?size=128")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+	assert.Empty(t, w.Header().Get("Set-Cookie"), "картинка кэшируется и не должна выдавать cookie")
+	img, err := png.Decode(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	assert.Equal(t, http.StatusNotModified, get("/x7kg9X5V/qr?size=128", "If-None-Match", etag).Code)
+	assert.Equal(t, http.StatusNotModified, get("/x7kg9X5V/qr?size=128", "If-None-Match", "W/"+etag).Code, "слабый тег тоже совпадает")
+	assert.Equal(t, http.StatusNotModified, get("/x7kg9X5V/qr?size=128", "If-None-Match", `"other", `+etag).Code, "тег ищется в списке")
+	assert.Equal(t, http.StatusOK, get("/x7kg9X5V/qr?size=128", "If-None-Match", `"other"`).Code)
+
+	w = get("/x7kg9X5V/qr?size=128", "Accept-Encoding", "gzip")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"), "png уже сжат")
+	_, err = png.Decode(w.Body)
+	require.NoError(t, err)
+	assert.NotEqual(t, etag, get("/x7kg9X5V/qr?size=256").Header().Get("ETag"), "ETag зависит от параметров")
+
+	w = get("/x7kg9X5V/qr?format=svg&margin=0&level=h")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "<svg "))
+
+	w = get("/x7kg9X5V/qr?format=svg", "Accept-Encoding", "gzip")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), "svg - это текст и сжимается")
+
+	w = get("/expiring/qr")
+	require.Equal(t, http.StatusOK, w.Code)
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(w.Header().Get("Cache-Control"), "public, max-age="))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, maxAge, 3600, "код истекающей ссылки кэшируется не дольше её жизни")
+
+	testCases := []struct {
+		target string
+		status int
+	}{
+		{target: "/missing/qr", status: http.StatusNotFound},
+		{target: "/deleted1/qr", status: http.StatusGone},
+		{target: "/x7kg9X5V/qr?size=10", status: http.StatusBadRequest},
+		{target: "/x7kg9X5V/qr?margin=-1", status: http.StatusBadRequest},
+		{target: "/x7kg9X5V/qr?level=X", status: http.StatusBadRequest},
+		{target: "/x7kg9X5V/qr?format=gif", status: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			assert.Equal(t, tc.status, get(tc.target).Code)
+		})
+	}
+}
+
+func TestPreview(t *testing.T) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	createdAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	require.NoError(t, storage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com/?q=<script>", CreatedAt: createdAt},
+		{ShortURL: "guarded1", OriginalURL: "http://ya.ru", Interstitial: true},
+		{ShortURL: "deleted1", OriginalURL: "http://go.dev", DeletedFlag: true},
+	}))
+	require.NoError(t, storage.SaveClicks([]models.Click{
+		{ShortURL: "x7kg9X5V", Time: time.Now(), VisitorHash: "a"},
+		{ShortURL: "x7kg9X5V", Time: time.Now(), VisitorHash: "b"},
+	}))
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	for _, target := range []string{"/x7kg9X5V+", "/x7kg9X5V?preview=1"} {
+		t.Run(target, func(t *testing.T) {
+			w := get(target)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+			body := w.Body.String()
+			assert.Contains(t, body, "http://google.com/?q=&lt;script&gt;", "адрес назначения экранируется")
+			assert.NotContains(t, body, "<script>")
+			assert.Contains(t, body, "2024-03-01 12:30 UTC")
+			assert.Contains(t, body, "<dd>2</dd>", "показано число переходов")
+			assert.Contains(t, body, `href="http://example.com/x7kg9X5V?confirm=1"`)
+		})
+	}
+
+	t.Run("interstitial", func(t *testing.T) {
+		w := get("/guarded1")
+		require.Equal(t, http.StatusOK, w.Code, "ссылка с флагом всегда показывает страницу")
+		assert.Contains(t, w.Body.String(), "http://ya.ru")
+		assert.Contains(t, w.Body.String(), "unknown", "дата создания неизвестна")
+
+		w = get("/guarded1?confirm=1")
+		require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+		assert.Equal(t, "http://ya.ru", w.Header().Get("Location"))
+	})
+
+	t.Run("plain redirect", func(t *testing.T) {
+		w := get("/x7kg9X5V")
+		require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	})
+
+	t.Run("flag from request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://example.org","interstitial":true}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		var resp models.CreateShortenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		id := strings.TrimPrefix(resp.URL, "http://example.com/")
+
+		rec, err := storage.Get(id)
+		require.NoError(t, err)
+		assert.True(t, rec.Interstitial)
+		assert.WithinDuration(t, time.Now(), rec.CreatedAt, time.Minute)
+		assert.Equal(t, http.StatusOK, get("/"+id).Code)
+	})
+
+	assert.Equal(t, http.StatusNotFound, get("/missing+").Code)
+	assert.Equal(t, http.StatusGone, get("/deleted1+").Code)
+}
+
+func TestRedirectTypes(t *testing.T) {
+	options := config.Options{
+		PublicHost:   "http://example.com",
+		RedirectCode: http.StatusFound,
+	}
+
+	storage := storage.NewInMemoryStorage()
+	services := service.NewService(&options, storage, storage)
+	defer services.Close()
+
+	expiresAt := time.Now().Add(time.Hour)
+	require.NoError(t, storage.SaveBatch([]*models.URLRecord{
+		{ShortURL: "default1", OriginalURL: "http://google.com"},
+		{ShortURL: "moved301", OriginalURL: "http://ya.ru", RedirectType: http.StatusMovedPermanently},
+		{ShortURL: "moved308", OriginalURL: "http://go.dev", RedirectType: http.StatusPermanentRedirect, ExpiresAt: &expiresAt},
+	}))
+
+	router := serverHandler(services, auth.NewAuthenticator("secret"))
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/default1")
+	assert.Equal(t, http.StatusFound, w.Code, "ссылка без типа использует код из настроек")
+	assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"), "временный редирект не кэшируется")
+
+	w = get("/moved301")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "http://ya.ru", w.Header().Get("Location"))
+	assert.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+	assert.Empty(t, w.Header().Values("Set-Cookie"), "общий кэш не должен сохранить чужую cookie")
+
+	for _, target := range []string{"/moved301", "/moved301+"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.AddCookie(&http.Cookie{Name: auth.CookieName, Value: "forged"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Empty(t, w.Header().Values("Set-Cookie"), "переход не выдаёт cookie даже взамен неверной: "+target)
+	}
+
+	w = get("/moved308")
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(w.Header().Get("Cache-Control"), "public, max-age="))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, maxAge, 3600, "редирект истекающей ссылки кэшируется не дольше её жизни")
+
+	t.Run("from request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://example.org","redirect_type":308}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		var resp models.CreateShortenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, http.StatusPermanentRedirect, get(strings.TrimPrefix(resp.URL, "http://example.com")).Code)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"http://example.net","redirect_type":200}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp models.ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, service.ReasonInvalidRedirectType, resp.Reason)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		next := options
+		next.RedirectCode = http.StatusMovedPermanently
+		require.NoError(t, services.Reload(&next))
+		assert.Equal(t, http.StatusMovedPermanently, get("/default1").Code, "код по умолчанию меняется без перезапуска")
+	})
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/n1l/url-shortener/internal/logger"
+)
+
+const CookieName = "user_id"
+
+var ErrInvalidToken = errors.New("invalid auth token")
+
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	rejectedKey
+	issuedKey
+	apiKeyKey
+)
+
+// Authenticator issues and verifies tokens of the form "<user id>.<hmac>",
+// where hmac is the hex encoded HMAC-SHA256 of the user id.
+type Authenticator struct {
+	secret []byte
+	keys   KeyStore
+}
+
+func NewAuthenticator(secret string, opts ...Option) *Authenticator {
+	a := &Authenticator{secret: []byte(secret)}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func (a *Authenticator) Sign(userID string) string {
+	return userID + "." + hex.EncodeToString(a.signature(userID))
+}
+
+func (a *Authenticator) Verify(token string) (string, error) {
+	userID, sign, ok := strings.Cut(token, ".")
+	if !ok || userID == "" {
+		return "", ErrInvalidToken
+	}
+
+	decoded, err := hex.DecodeString(sign)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	if !hmac.Equal(decoded, a.signature(userID)) {
+		return "", ErrInvalidToken
+	}
+
+	return userID, nil
+}
+
+// Middleware puts the user id from a valid API key or auth cookie into
+// the request context. Requests with an invalid API key are rejected,
+// requests without a valid cookie get a new user id and cookie.
+func (a *Authenticator) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if token, ok := apiKeyFromRequest(r); ok {
+			key, err := a.VerifyKey(token)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			ctx = context.WithValue(ctx, apiKeyKey, key)
+			h.ServeHTTP(w, r.WithContext(WithUserID(ctx, key.UserID)))
+			return
+		}
+
+		if cookie, err := r.Cookie(CookieName); err == nil {
+			if userID, err := a.Verify(cookie.Value); err == nil {
+				h.ServeHTTP(w, r.WithContext(WithUserID(ctx, userID)))
+				return
+			}
+			ctx = context.WithValue(ctx, rejectedKey, true)
+		}
+
+		userID, err := NewUserID()
+		if err != nil {
+			logger.Log.Error("failed to generate user id", zap.Error(err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     CookieName,
+			Value:    a.Sign(userID),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		ctx = context.WithValue(ctx, issuedKey, true)
+		h.ServeHTTP(w, r.WithContext(WithUserID(ctx, userID)))
+	})
+}
+
+// UnaryServerInterceptor is the gRPC counterpart of Middleware, the API
+// key travels in the authorization or x-api-key metadata and the token
+// under the cookie name. Calls with an invalid key or token are rejected,
+// as RequireUser does for HTTP.
+func (a *Authenticator) UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if token, ok := apiKeyFromMetadata(md); ok {
+		key, err := a.VerifyKey(token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		ctx = context.WithValue(ctx, apiKeyKey, key)
+		return handler(WithUserID(ctx, key.UserID), req)
+	}
+
+	if tokens := md.Get(CookieName); len(tokens) > 0 {
+		userID, err := a.Verify(tokens[0])
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		return handler(WithUserID(ctx, userID), req)
+	}
+
+	userID, err := NewUserID()
+	if err != nil {
+		logger.Log.Error("failed to generate user id", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to generate user id")
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(CookieName, a.Sign(userID))); err != nil {
+		return nil, err
+	}
+
+	return handler(WithUserID(ctx, userID), req)
+}
+
+// RequireUser answers 401 to requests that came with an invalid auth
+// cookie or passed no authenticator at all.
+func RequireUser(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := UserIDFromContext(r.Context())
+		rejected, _ := r.Context().Value(rejectedKey).(bool)
+		if !ok || rejected {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDKey).(string)
+	return userID, ok && userID != ""
+}
+
+// Issued reports whether the user id was issued for this request rather
+// than presented by the client.
+func Issued(ctx context.Context) bool {
+	issued, _ := ctx.Value(issuedKey).(bool)
+	return issued
+}
+
+func NewUserID() (string, error) {
+	return randomHex(16)
+}
+
+func NewSecretKey() (string, error) {
+	return randomHex(32)
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (a *Authenticator) signature(userID string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(userID))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// The scopes of API keys. The requests authenticated with a cookie are
+// allowed everything.
+const (
+	ScopeShorten = "shorten"
+	ScopeDelete  = "delete"
+	ScopeStats   = "stats"
+)
+
+var Scopes = []string{ScopeShorten, ScopeDelete, ScopeStats}
+
+var ErrInvalidKey = errors.New("invalid api key")
+
+const APIKeyHeader = "X-API-Key"
+
+// KeyStore keeps the API keys. It never sees the secrets, only their
+// hashes.
+type KeyStore interface {
+	SaveAPIKey(key *models.APIKey) error
+	GetAPIKey(id string) (*models.APIKey, bool)
+	ListAPIKeys() ([]*models.APIKey, error)
+	RevokeAPIKey(id string, at time.Time) error
+}
+
+type Option func(a *Authenticator)
+
+// WithKeyStore lets the clients authenticate with the API keys from keys.
+func WithKeyStore(keys KeyStore) Option {
+	return func(a *Authenticator) {
+		a.keys = keys
+	}
+}
+
+// NewAPIKey generates a key of the form "<id>.<secret>" for the user and
+// returns it along with the record to store. The key itself cannot be
+// recovered from the record.
+func NewAPIKey(userID, name string, scopes []string) (string, *models.APIKey, error) {
+	if len(scopes) == 0 {
+		return "", nil, errors.New("api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return "", nil, fmt.Errorf("unknown scope '%s', use %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id + "." + secret, &models.APIKey{
+		ID:        id,
+		Hash:      hashSecret(secret),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// VerifyKey returns the stored record of a valid key that has not been
+// revoked.
+func (a *Authenticator) VerifyKey(token string) (*models.APIKey, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || a.keys == nil {
+		return nil, ErrInvalidKey
+	}
+
+	key, ok := a.keys.GetAPIKey(id)
+	if !ok || key.RevokedAt != nil {
+		return nil, ErrInvalidKey
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+// KeyFromContext returns the API key the request was authenticated with.
+func KeyFromContext(ctx context.Context) (*models.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(*models.APIKey)
+	return key, ok
+}
+
+// RequireScope answers 403 to requests authenticated with an API key
+// that lacks the scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := KeyFromContext(r.Context()); ok && !key.HasScope(scope) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UnaryScopeInterceptor is the gRPC counterpart of RequireScope, scopes
+// maps the full method names to the scope they take. The calls of other
+// methods pass with any key.
+func UnaryScopeInterceptor(scopes map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if scope, ok := scopes[info.FullMethod]; ok {
+			if key, ok := KeyFromContext(ctx); ok && !key.HasScope(scope) {
+				return nil, status.Errorf(codes.PermissionDenied, "api key lacks the %s scope", scope)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// apiKeyFromRequest takes the key from the Authorization bearer token or
+// the X-API-Key header.
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token), true
+	}
+	if token := r.Header.Get(APIKeyHeader); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// apiKeyFromMetadata is apiKeyFromRequest for the gRPC metadata, where
+// the keys are lower case.
+func apiKeyFromMetadata(md metadata.MD) (string, bool) {
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+			return strings.TrimSpace(token), true
+		}
+	}
+	if tokens := md.Get(APIKeyHeader); len(tokens) > 0 && tokens[0] != "" {
+		return tokens[0], true
+	}
+	return "", false
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
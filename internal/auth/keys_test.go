@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+type keyStore map[string]*models.APIKey
+
+func (s keyStore) SaveAPIKey(key *models.APIKey) error {
+	s[key.ID] = key
+	return nil
+}
+
+func (s keyStore) GetAPIKey(id string) (*models.APIKey, bool) {
+	key, ok := s[id]
+	return key, ok
+}
+
+func (s keyStore) ListAPIKeys() ([]*models.APIKey, error) {
+	keys := make([]*models.APIKey, 0, len(s))
+	for _, key := range s {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s keyStore) RevokeAPIKey(id string, at time.Time) error {
+	revoked := *s[id]
+	revoked.RevokedAt = &at
+	s[id] = &revoked
+	return nil
+}
+
+func newTestKey(t *testing.T, keys keyStore, scopes ...string) (string, *models.APIKey) {
+	token, key, err := NewAPIKey("jobs", "test", scopes)
+	require.NoError(t, err)
+	require.NoError(t, keys.SaveAPIKey(key))
+	return token, key
+}
+
+func TestNewAPIKey(t *testing.T) {
+	_, _, err := NewAPIKey("jobs", "", nil)
+	assert.Error(t, err, "ключ без прав не создаётся")
+	_, _, err = NewAPIKey("jobs", "", []string{"admin"})
+	assert.Error(t, err, "неизвестное право не принимается")
+}
+
+func TestVerifyKey(t *testing.T) {
+	keys := keyStore{}
+	a := NewAuthenticator("secret", WithKeyStore(keys))
+
+	token, stored := newTestKey(t, keys, ScopeShorten)
+	revokedToken, revoked := newTestKey(t, keys, ScopeShorten)
+	require.NoError(t, keys.RevokeAPIKey(revoked.ID, time.Now()))
+
+	key, err := a.VerifyKey(token)
+	require.NoError(t, err)
+	assert.Equal(t, stored, key)
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{name: "tampered secret", token: token[:len(token)-1] + "x"},
+		{name: "foreign secret", token: stored.ID + "." + revokedToken[len(revoked.ID)+1:]},
+		{name: "unknown id", token: "0000000000000000" + token[len(stored.ID):]},
+		{name: "no secret", token: stored.ID},
+		{name: "revoked", token: revokedToken},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := a.VerifyKey(tc.token)
+			assert.ErrorIs(t, err, ErrInvalidKey)
+		})
+	}
+
+	_, err = NewAuthenticator("secret").VerifyKey(token)
+	assert.ErrorIs(t, err, ErrInvalidKey, "без хранилища ключи не принимаются")
+}
+
+func TestRequireScope(t *testing.T) {
+	keys := keyStore{}
+	a := NewAuthenticator("secret", WithKeyStore(keys))
+	shortenToken, _ := newTestKey(t, keys, ScopeShorten)
+	statsToken, _ := newTestKey(t, keys, ScopeShorten, ScopeStats)
+
+	handler := a.Middleware(RequireScope(ScopeStats)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	do := func(header, value string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/urls/x7kg9X5V/stats", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, do(APIKeyHeader, shortenToken), "ключу не хватает права")
+	assert.Equal(t, http.StatusOK, do(APIKeyHeader, statsToken))
+	assert.Equal(t, http.StatusOK, do("Authorization", "Bearer "+statsToken))
+	assert.Equal(t, http.StatusUnauthorized, do(APIKeyHeader, statsToken+"x"), "подделанный ключ не принимается")
+	assert.Equal(t, http.StatusOK, do("", ""), "пользователю с cookie разрешено всё")
+}
+
+func TestUnaryScopeInterceptor(t *testing.T) {
+	keys := keyStore{}
+	a := NewAuthenticator("secret", WithKeyStore(keys))
+	shortenToken, _ := newTestKey(t, keys, ScopeShorten)
+	deleteToken, deleteKey := newTestKey(t, keys, ScopeDelete)
+
+	const method = "/shortener.Shortener/Delete"
+	interceptor := UnaryScopeInterceptor(map[string]string{method: ScopeDelete})
+	handler := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+	call := func(fullMethod string, md metadata.MD) error {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := a.UnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: fullMethod},
+			func(ctx context.Context, req any) (any, error) {
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: fullMethod}, handler)
+			})
+		return err
+	}
+
+	err := call(method, metadata.Pairs("x-api-key", shortenToken))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "ключу не хватает права")
+	assert.NoError(t, call(method, metadata.Pairs("authorization", "Bearer "+deleteToken)))
+	assert.NoError(t, call("/shortener.Shortener/Expand", metadata.Pairs("x-api-key", shortenToken)), "метод без права доступен любому ключу")
+	assert.NoError(t, call(method, metadata.Pairs(CookieName, a.Sign("user"))), "пользователю с cookie разрешено всё")
+
+	require.NoError(t, keys.RevokeAPIKey(deleteKey.ID, time.Now()))
+	err = call(method, metadata.Pairs("x-api-key", deleteToken))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "отозванный ключ не принимается")
+}
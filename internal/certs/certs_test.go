@@ -0,0 +1,77 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSigned(t *testing.T) {
+	cert, err := SelfSigned("localhost", "127.0.0.1")
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	res, err := client.Get(srv.URL)
+	require.NoError(t, err, "сертификат должен приниматься для 127.0.0.1")
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func writePair(t *testing.T, certFile, keyFile string, modTime time.Time) *tls.Certificate {
+	t.Helper()
+
+	cert, err := SelfSigned("localhost")
+	require.NoError(t, err)
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return cert
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first := writePair(t, certFile, keyFile, time.Now().Add(-time.Hour))
+
+	reloader, err := NewReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	got, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Certificate, got.Certificate)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Run(ctx, 10*time.Millisecond)
+
+	second := writePair(t, certFile, keyFile, time.Now())
+
+	assert.Eventually(t, func() bool {
+		got, _ := reloader.GetCertificate(nil)
+		return assert.ObjectsAreEqual(second.Certificate, got.Certificate)
+	}, time.Second, 10*time.Millisecond, "сертификат должен перечитываться после замены файлов")
+}
@@ -1,28 +1,379 @@
+// Package config assembles the service options. Every option is taken
+// from the first source that sets it: command line flags, environment
+// variables, the config file given by -c or CONFIG, and the defaults.
 package config
 
 import (
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
+// Options fields tagged reload:"true" are applied to the running service
+// on SIGHUP, the other ones take a restart.
 type Options struct {
-	PrivateHost string `env:"SERVER_ADDRESS"`
-	PublicHost  string `env:"BASE_URL"`
-	StoragePath string `env:"FILE_STORAGE_PATH"`
-	LogLevel    string `env:"LOG_LEVEL"`
+	ConfigFile  string `env:"CONFIG" yaml:"-"`
+	PrintConfig bool   `yaml:"-"`
+
+	PrivateHost string `env:"SERVER_ADDRESS" yaml:"server_address"`
+	GRPCAddress string `env:"GRPC_ADDRESS" yaml:"grpc_address"`
+	PublicHost  string `env:"BASE_URL" yaml:"base_url" reload:"true"`
+
+	EnableHTTPS bool   `env:"ENABLE_HTTPS" yaml:"enable_https"`
+	TLSCertFile string `env:"TLS_CERT_FILE" yaml:"tls_cert_file"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE" yaml:"tls_key_file"`
+
+	// TrustedSubnet is matched against the connection address, or the
+	// X-Real-IP header when the connection comes from TrustedProxies
+	TrustedSubnet string `env:"TRUSTED_SUBNET" yaml:"trusted_subnet" reload:"true"`
+	// the proxies whose X-Real-IP header names the client, the header of
+	// anybody else is ignored
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:"," yaml:"trusted_proxies" reload:"true"`
+
+	// the status of the redirects of links created without a redirect type
+	RedirectCode int `env:"REDIRECT_CODE" yaml:"redirect_code" reload:"true"`
+
+	AllowedSchemes []string `env:"ALLOWED_SCHEMES" envSeparator:"," yaml:"allowed_schemes" reload:"true"`
+	BlocklistFile  string   `env:"BLOCKLIST_FILE" yaml:"blocklist_file" reload:"true"`
+
+	StoragePath string `env:"FILE_STORAGE_PATH" yaml:"file_storage_path"`
+	LogLevel    string `env:"LOG_LEVEL" yaml:"log_level" reload:"true"`
+	DatabaseDSN string `env:"DATABASE_DSN" yaml:"database_dsn"`
+	IDGenerator string `env:"ID_GENERATOR" yaml:"id_generator"`
+	IDLength    int    `env:"ID_LENGTH" yaml:"id_length" reload:"true"`
+	SecretKey   string `env:"SECRET_KEY" yaml:"secret_key"`
+
+	ReapInterval  time.Duration `env:"REAP_INTERVAL" yaml:"reap_interval"`
+	ShutdownDelay time.Duration `env:"SHUTDOWN_DELAY" yaml:"shutdown_delay"`
+
+	FileSync             string `env:"FILE_SYNC" yaml:"file_sync"`
+	FileCompactThreshold int64  `env:"FILE_COMPACT_THRESHOLD" yaml:"file_compact_threshold"`
+
+	// requests per second and burst per client, a zero rate disables the limit
+	CreateRateLimit   float64       `env:"CREATE_RATE_LIMIT" yaml:"create_rate_limit" reload:"true"`
+	CreateRateBurst   int           `env:"CREATE_RATE_BURST" yaml:"create_rate_burst" reload:"true"`
+	RedirectRateLimit float64       `env:"REDIRECT_RATE_LIMIT" yaml:"redirect_rate_limit" reload:"true"`
+	RedirectRateBurst int           `env:"REDIRECT_RATE_BURST" yaml:"redirect_rate_burst" reload:"true"`
+	RateLimitIdle     time.Duration `env:"RATE_LIMIT_IDLE" yaml:"rate_limit_idle" reload:"true"`
+}
+
+// Reparse reads the options again from the sources ParseOptions used.
+func Reparse(ops *Options) error {
+	return Parse(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:], ops)
 }
 
-func ParseOptions(ops *Options) {
-	flag.StringVar(&ops.PrivateHost, "a", "localhost:8080", "The service address at start")
-	flag.StringVar(&ops.PublicHost, "b", "http://localhost:8080", "The shortener result base address")
-	flag.StringVar(&ops.StoragePath, "f", "/tmp/short-url-db.json", "The shortener file storage")
-	flag.StringVar(&ops.LogLevel, "l", "Debug", "Logger level")
-	flag.Parse()
+// Reload returns a copy of ops with the reloadable options taken from
+// next, and the config file names of the other options that differ in
+// next and need a restart to apply.
+func (ops *Options) Reload(next *Options) (*Options, []string) {
+	applied := *ops
+	var ignored []string
 
-	err := env.Parse(ops)
+	cur, nxt, out := reflect.ValueOf(ops).Elem(), reflect.ValueOf(next).Elem(), reflect.ValueOf(&applied).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		name := field.Tag.Get("yaml")
+		switch {
+		case name == "-":
+		case field.Tag.Get("reload") == "true":
+			out.Field(i).Set(nxt.Field(i))
+		case !reflect.DeepEqual(cur.Field(i).Interface(), nxt.Field(i).Interface()):
+			ignored = append(ignored, name)
+		}
+	}
+	return &applied, ignored
+}
+
+func Defaults() Options {
+	return Options{
+		PrivateHost:          "localhost:8080",
+		GRPCAddress:          "localhost:3200",
+		PublicHost:           "http://localhost:8080",
+		StoragePath:          "/tmp/short-url-db.json",
+		LogLevel:             "debug",
+		RedirectCode:         307,
+		AllowedSchemes:       []string{"http", "https"},
+		IDGenerator:          "hash",
+		IDLength:             8,
+		ReapInterval:         time.Minute,
+		ShutdownDelay:        5 * time.Second,
+		FileSync:             "interval",
+		FileCompactThreshold: 16 << 20,
+		CreateRateLimit:      2,
+		CreateRateBurst:      20,
+		RedirectRateLimit:    20,
+		RedirectRateBurst:    100,
+		RateLimitIdle:        10 * time.Minute,
+	}
+}
+
+// ParseOptions fills ops from the command line, the environment and the
+// config file and validates the result.
+func ParseOptions(ops *Options) error {
+	return Parse(flag.CommandLine, os.Args[1:], ops)
+}
+
+// Parse is ParseOptions for the given flag set and arguments.
+func Parse(fs *flag.FlagSet, args []string, ops *Options) error {
+	*ops = Defaults()
+
+	// the config file goes before the flags, so its name is looked up first
+	var scratch Options
+	pre := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	pre.SetOutput(io.Discard)
+	bindFlags(pre, &scratch)
+	pre.Parse(args)
+
+	ops.ConfigFile = scratch.ConfigFile
+	if ops.ConfigFile == "" {
+		ops.ConfigFile = os.Getenv("CONFIG")
+	}
+	if ops.ConfigFile != "" {
+		if err := LoadFile(ops.ConfigFile, ops); err != nil {
+			return err
+		}
+	}
+
+	if err := env.Parse(ops); err != nil {
+		return fmt.Errorf("failed to read environment variables: %w", err)
+	}
+
+	// the flags default to the values gathered so far and override them
+	// only when given explicitly
+	bindFlags(fs, ops)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if ops.EnableHTTPS && ops.PublicHost == Defaults().PublicHost {
+		ops.PublicHost = "https://" + strings.TrimPrefix(ops.PublicHost, "http://")
+	}
+
+	return ops.Validate()
+}
+
+func bindFlags(fs *flag.FlagSet, ops *Options) {
+	fs.StringVar(&ops.ConfigFile, "c", ops.ConfigFile, "The JSON or YAML config file")
+	fs.BoolVar(&ops.PrintConfig, "print-config", false, "Print the effective configuration and exit")
+	fs.StringVar(&ops.PrivateHost, "a", ops.PrivateHost, "The service address at start")
+	fs.StringVar(&ops.GRPCAddress, "g", ops.GRPCAddress, "The gRPC service address, empty disables it")
+	fs.StringVar(&ops.PublicHost, "b", ops.PublicHost, "The shortener result base address")
+	fs.BoolVar(&ops.EnableHTTPS, "s", ops.EnableHTTPS, "Serve HTTPS, with a self-signed certificate if no files are given")
+	fs.StringVar(&ops.TLSCertFile, "tls-cert", ops.TLSCertFile, "The TLS certificate file")
+	fs.StringVar(&ops.TLSKeyFile, "tls-key", ops.TLSKeyFile, "The TLS private key file")
+	fs.StringVar(&ops.TrustedSubnet, "t", ops.TrustedSubnet, "The CIDR allowed to read the internal stats, empty disables them. Behind a proxy it takes -trusted-proxies")
+	fs.Var((*stringList)(&ops.TrustedProxies), "trusted-proxies", "Comma separated CIDRs of the proxies whose X-Real-IP header is trusted, it is ignored otherwise")
+	fs.IntVar(&ops.RedirectCode, "redirect-code", ops.RedirectCode, "The default redirect status: 301, 302, 307 or 308")
+	fs.Var((*stringList)(&ops.AllowedSchemes), "allowed-schemes", "Comma separated URL schemes allowed to shorten")
+	fs.StringVar(&ops.BlocklistFile, "blocklist", ops.BlocklistFile, "The file with the blocked domains, one per line")
+	fs.StringVar(&ops.StoragePath, "f", ops.StoragePath, "The shortener file storage")
+	fs.StringVar(&ops.LogLevel, "l", ops.LogLevel, "Logger level")
+	fs.StringVar(&ops.DatabaseDSN, "d", ops.DatabaseDSN, "The shortener database connection string")
+	fs.StringVar(&ops.IDGenerator, "id-generator", ops.IDGenerator, "The short id generator: hash or random")
+	fs.IntVar(&ops.IDLength, "id-length", ops.IDLength, "The short id length")
+	fs.StringVar(&ops.SecretKey, "k", ops.SecretKey, "The auth cookie signing key, random if empty")
+	fs.DurationVar(&ops.ReapInterval, "reap-interval", ops.ReapInterval, "How often expired links are purged")
+	fs.DurationVar(&ops.ShutdownDelay, "shutdown-delay", ops.ShutdownDelay, "How long the server reports not ready before shutting down")
+	fs.StringVar(&ops.FileSync, "file-sync", ops.FileSync, "When the file storage syncs writes to disk: always, interval or never")
+	fs.Int64Var(&ops.FileCompactThreshold, "file-compact-threshold", ops.FileCompactThreshold, "The file storage size in bytes that triggers compaction, 0 disables it")
+	fs.Float64Var(&ops.CreateRateLimit, "create-rate-limit", ops.CreateRateLimit, "Links a client may create per second, 0 disables the limit")
+	fs.IntVar(&ops.CreateRateBurst, "create-rate-burst", ops.CreateRateBurst, "Links a client may create at once")
+	fs.Float64Var(&ops.RedirectRateLimit, "redirect-rate-limit", ops.RedirectRateLimit, "Redirects a client may follow per second, 0 disables the limit")
+	fs.IntVar(&ops.RedirectRateBurst, "redirect-rate-burst", ops.RedirectRateBurst, "Redirects a client may follow at once")
+	fs.DurationVar(&ops.RateLimitIdle, "rate-limit-idle", ops.RateLimitIdle, "How long the limits of an idle client are kept")
+}
+
+// LoadFile reads the options set in the config file into ops. JSON is a
+// subset of YAML, so both formats go through the YAML decoder, durations
+// are written as strings like "1m30s".
+func LoadFile(filename string, ops *Options) error {
+	file, err := os.Open(filename)
 	if err != nil {
-		log.Print("Failed to read environment variables")
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer file.Close()
+
+	dec := yaml.NewDecoder(file)
+	dec.KnownFields(true)
+	if err := dec.Decode(ops); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Validate checks every option and normalizes the log level name.
+func (ops *Options) Validate() error {
+	var errs []error
+	invalid := func(name string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s: %w", name, err))
+	}
+
+	if err := validateAddress(ops.PrivateHost); err != nil {
+		invalid("SERVER_ADDRESS (-a)", err)
+	}
+	if ops.GRPCAddress != "" {
+		if err := validateAddress(ops.GRPCAddress); err != nil {
+			invalid("GRPC_ADDRESS (-g)", err)
+		}
+	}
+	if err := validateBaseURL(ops.PublicHost); err != nil {
+		invalid("BASE_URL (-b)", err)
+	}
+
+	if (ops.TLSCertFile == "") != (ops.TLSKeyFile == "") {
+		invalid("TLS_CERT_FILE (-tls-cert) and TLS_KEY_FILE (-tls-key)", errors.New("must be given together"))
+	}
+
+	if ops.TrustedSubnet != "" {
+		if _, err := netip.ParsePrefix(ops.TrustedSubnet); err != nil {
+			invalid("TRUSTED_SUBNET (-t)", fmt.Errorf("%w, it is a CIDR matched against the client address, see TRUSTED_PROXIES", err))
+		}
+	}
+	for _, proxy := range ops.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			invalid("TRUSTED_PROXIES (-trusted-proxies)", err)
+		}
+	}
+
+	switch ops.RedirectCode {
+	case 301, 302, 307, 308:
+	default:
+		invalid("REDIRECT_CODE (-redirect-code)", fmt.Errorf("%d is none of 301, 302, 307 and 308", ops.RedirectCode))
+	}
+
+	if len(ops.AllowedSchemes) == 0 {
+		invalid("ALLOWED_SCHEMES (-allowed-schemes)", errors.New("must not be empty"))
+	}
+	for i, scheme := range ops.AllowedSchemes {
+		ops.AllowedSchemes[i] = strings.ToLower(strings.TrimSpace(scheme))
+		if _, err := url.Parse(ops.AllowedSchemes[i] + ":"); err != nil || ops.AllowedSchemes[i] == "" {
+			invalid("ALLOWED_SCHEMES (-allowed-schemes)", fmt.Errorf("bad scheme '%s'", scheme))
+		}
+	}
+
+	ops.LogLevel = strings.ToLower(ops.LogLevel)
+	if _, err := zap.ParseAtomicLevel(ops.LogLevel); err != nil {
+		invalid("LOG_LEVEL (-l)", err)
+	}
+
+	switch ops.IDGenerator {
+	case "hash", "random":
+	default:
+		invalid("ID_GENERATOR (-id-generator)", fmt.Errorf("'%s' is neither hash nor random", ops.IDGenerator))
+	}
+	if ops.IDLength < 1 {
+		invalid("ID_LENGTH (-id-length)", errors.New("must be positive"))
+	}
+
+	if ops.ReapInterval <= 0 {
+		invalid("REAP_INTERVAL (-reap-interval)", errors.New("must be positive"))
+	}
+	if ops.ShutdownDelay < 0 {
+		invalid("SHUTDOWN_DELAY (-shutdown-delay)", errors.New("must not be negative"))
+	}
+
+	switch ops.FileSync {
+	case "always", "interval", "never":
+	default:
+		invalid("FILE_SYNC (-file-sync)", fmt.Errorf("'%s' is none of always, interval and never", ops.FileSync))
+	}
+	if ops.FileCompactThreshold < 0 {
+		invalid("FILE_COMPACT_THRESHOLD (-file-compact-threshold)", errors.New("must not be negative"))
+	}
+
+	if ops.CreateRateLimit < 0 {
+		invalid("CREATE_RATE_LIMIT (-create-rate-limit)", errors.New("must not be negative"))
+	}
+	if ops.CreateRateLimit > 0 && ops.CreateRateBurst < 1 {
+		invalid("CREATE_RATE_BURST (-create-rate-burst)", errors.New("must be positive"))
+	}
+	if ops.RedirectRateLimit < 0 {
+		invalid("REDIRECT_RATE_LIMIT (-redirect-rate-limit)", errors.New("must not be negative"))
+	}
+	if ops.RedirectRateLimit > 0 && ops.RedirectRateBurst < 1 {
+		invalid("REDIRECT_RATE_BURST (-redirect-rate-burst)", errors.New("must be positive"))
+	}
+	if ops.RateLimitIdle <= 0 {
+		invalid("RATE_LIMIT_IDLE (-rate-limit-idle)", errors.New("must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("bad port '%s'", port)
+	}
+	return nil
+}
+
+func validateBaseURL(base string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("'%s' must be an absolute http or https URL", base)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("'%s' has no host", base)
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		return fmt.Errorf("'%s' must not end with a slash", base)
+	}
+	return nil
+}
+
+// stringList is a flag.Value of comma separated strings.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// Print writes the options in the config file format with the secrets
+// masked.
+func (ops Options) Print(w io.Writer) error {
+	if ops.SecretKey != "" {
+		ops.SecretKey = "***"
+	}
+	if u, err := url.Parse(ops.DatabaseDSN); err == nil && u.Scheme != "" {
+		ops.DatabaseDSN = u.Redacted()
+	} else {
+		ops.DatabaseDSN = dsnPassword.ReplaceAllString(ops.DatabaseDSN, "password=xxxxx")
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(ops); err != nil {
+		return err
 	}
+	return enc.Close()
 }
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parse(t *testing.T, args ...string) (Options, error) {
+	t.Helper()
+	var ops Options
+	err := Parse(flag.NewFlagSet("test", flag.ContinueOnError), args, &ops)
+	return ops, err
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0666))
+	return path
+}
+
+func TestParsePrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+server_address: file:1
+base_url: http://file.io
+log_level: warn
+reap_interval: 2m
+`)
+
+	t.Run("defaults", func(t *testing.T) {
+		ops, err := parse(t)
+		require.NoError(t, err)
+		assert.Equal(t, Defaults(), ops)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		ops, err := parse(t, "-c", path)
+		require.NoError(t, err)
+		assert.Equal(t, "file:1", ops.PrivateHost)
+		assert.Equal(t, "warn", ops.LogLevel)
+		assert.Equal(t, 2*time.Minute, ops.ReapInterval)
+		assert.Equal(t, "hash", ops.IDGenerator, "незаданные в файле поля берутся по умолчанию")
+	})
+
+	t.Run("env over file", func(t *testing.T) {
+		t.Setenv("CONFIG", path)
+		t.Setenv("BASE_URL", "http://env.io")
+		ops, err := parse(t)
+		require.NoError(t, err)
+		assert.Equal(t, "file:1", ops.PrivateHost)
+		assert.Equal(t, "http://env.io", ops.PublicHost)
+	})
+
+	t.Run("flags over env", func(t *testing.T) {
+		t.Setenv("BASE_URL", "http://env.io")
+		t.Setenv("SERVER_ADDRESS", "env:2")
+		ops, err := parse(t, "-c", path, "-b", "http://flag.io")
+		require.NoError(t, err)
+		assert.Equal(t, "env:2", ops.PrivateHost)
+		assert.Equal(t, "http://flag.io", ops.PublicHost)
+		assert.Equal(t, "warn", ops.LogLevel)
+	})
+}
+
+func TestParseJSONFile(t *testing.T) {
+	path := writeFile(t, "config.json", `{"base_url": "https://s.io", "id_length": 10, "shutdown_delay": "1s"}`)
+
+	ops, err := parse(t, "-c", path)
+	require.NoError(t, err)
+	assert.Equal(t, "https://s.io", ops.PublicHost)
+	assert.Equal(t, 10, ops.IDLength)
+	assert.Equal(t, time.Second, ops.ShutdownDelay)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "address", args: []string{"-a", "localhost"}, want: "SERVER_ADDRESS"},
+		{name: "relative base url", args: []string{"-b", "localhost:8080"}, want: "BASE_URL"},
+		{name: "log level", args: []string{"-l", "loud"}, want: "LOG_LEVEL"},
+		{name: "unknown file field", args: []string{"-c", writeFile(t, "bad.yaml", "color: red\n")}, want: "color"},
+		{name: "rate limit without burst", args: []string{"-create-rate-limit", "5", "-create-rate-burst", "0"}, want: "CREATE_RATE_BURST"},
+		{name: "redirect code", args: []string{"-redirect-code", "200"}, want: "REDIRECT_CODE"},
+		{name: "trusted proxy", args: []string{"-trusted-proxies", "10.0.0.1"}, want: "TRUSTED_PROXIES"},
+		{name: "missing file", args: []string{"-c", "/nonexistent/config.json"}, want: "config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse(t, tt.args...)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+
+	t.Run("log level case", func(t *testing.T) {
+		ops, err := parse(t, "-l", "Info")
+		require.NoError(t, err)
+		assert.Equal(t, "info", ops.LogLevel)
+	})
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	ops := Defaults()
+	ops.SecretKey = "secret"
+	ops.DatabaseDSN = "host=db user=app password=hunter2"
+
+	var sb strings.Builder
+	require.NoError(t, ops.Print(&sb))
+	assert.NotContains(t, sb.String(), "secret_key: secret")
+	assert.NotContains(t, sb.String(), "hunter2")
+	assert.Contains(t, sb.String(), "reap_interval: 1m0s")
+}
+
+func TestReload(t *testing.T) {
+	current := Defaults()
+	next := Defaults()
+	next.LogLevel = "error"
+	next.PublicHost = "https://s.io"
+	next.PrivateHost = "localhost:9090"
+	next.StoragePath = "/var/lib/shortener.json"
+
+	applied, ignored := current.Reload(&next)
+
+	assert.Equal(t, "error", applied.LogLevel)
+	assert.Equal(t, "https://s.io", applied.PublicHost)
+	assert.Equal(t, current.PrivateHost, applied.PrivateHost, "адрес меняется только после перезапуска")
+	assert.Equal(t, current.StoragePath, applied.StoragePath)
+	assert.ElementsMatch(t, []string{"server_address", "file_storage_path"}, ignored)
+	assert.Equal(t, "http://localhost:8080", current.PublicHost, "текущие настройки не меняются")
+}
+
+func TestParseHTTPS(t *testing.T) {
+	ops, err := parse(t, "-s")
+	require.NoError(t, err)
+	assert.Equal(t, "https://localhost:8080", ops.PublicHost, "в режиме HTTPS адрес по умолчанию с https")
+
+	ops, err = parse(t, "-s", "-b", "https://s.io")
+	require.NoError(t, err)
+	assert.Equal(t, "https://s.io", ops.PublicHost)
+
+	_, err = parse(t, "-s", "-tls-cert", "cert.pem")
+	assert.Error(t, err, "сертификат без ключа")
+}
+
+func TestParseAllowedSchemes(t *testing.T) {
+	t.Setenv("ALLOWED_SCHEMES", "http,https,FTP")
+	ops, err := parse(t)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http", "https", "ftp"}, ops.AllowedSchemes)
+
+	ops, err = parse(t, "-allowed-schemes", "https")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https"}, ops.AllowedSchemes, "флаг заменяет список целиком")
+}
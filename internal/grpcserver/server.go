@@ -0,0 +1,162 @@
+// Package grpcserver exposes the shortener over gRPC on top of the same
+// service.Service the HTTP handlers use.
+package grpcserver
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pb/shortener.proto
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/grpcserver/pb"
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+	"github.com/n1l/url-shortener/internal/service"
+	"github.com/n1l/url-shortener/internal/storage"
+)
+
+type Server struct {
+	pb.UnimplementedShortenerServer
+
+	services *service.Service
+}
+
+// methodScopes are the scopes the API keys need for the methods, as on
+// the matching HTTP routes.
+var methodScopes = map[string]string{
+	pb.Shortener_Shorten_FullMethodName:      auth.ScopeShorten,
+	pb.Shortener_ShortenBatch_FullMethodName: auth.ScopeShorten,
+	pb.Shortener_Delete_FullMethodName:       auth.ScopeDelete,
+}
+
+// NewServer returns a gRPC server with the shortener registered and the
+// logging and auth interceptors installed.
+func NewServer(services *service.Service, authenticator *auth.Authenticator, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(
+		logger.UnaryServerInterceptor,
+		authenticator.UnaryServerInterceptor,
+		auth.UnaryScopeInterceptor(methodScopes),
+	))
+	server := grpc.NewServer(opts...)
+	pb.RegisterShortenerServer(server, &Server{services: services})
+	return server
+}
+
+func (s *Server) Shorten(ctx context.Context, in *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	req := &models.CreateShortenRequest{
+		URL:          in.GetUrl(),
+		Alias:        in.GetAlias(),
+		TTLSeconds:   in.GetTtlSeconds(),
+		Interstitial: in.GetInterstitial(),
+		RedirectType: int(in.GetRedirectType()),
+	}
+	if in.GetExpiresAt() != nil {
+		expiresAt := in.GetExpiresAt().AsTime()
+		req.ExpiresAt = &expiresAt
+	}
+
+	userID, _ := auth.UserIDFromContext(ctx)
+	rec, err := s.services.Shorten(userID, req)
+
+	var existsErr *storage.AlreadyExistsError
+	var takenErr *storage.IDTakenError
+	switch {
+	case errors.As(err, &existsErr):
+		return &pb.ShortenResponse{
+			Result:        s.services.ShortURL(existsErr.Existing.ShortURL),
+			AlreadyExists: true,
+		}, nil
+	case errors.As(err, &takenErr):
+		return nil, status.Errorf(codes.AlreadyExists, "alias '%s' is already taken", req.Alias)
+	case err != nil:
+		return nil, convertError(err)
+	}
+
+	return &pb.ShortenResponse{Result: s.services.ShortURL(rec.ShortURL)}, nil
+}
+
+func (s *Server) ShortenBatch(ctx context.Context, in *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	items := make([]models.CreateShortenBatchRequestItem, 0, len(in.GetItems()))
+	for _, item := range in.GetItems() {
+		items = append(items, models.CreateShortenBatchRequestItem{
+			CorrelationID: item.GetCorrelationId(),
+			OriginalURL:   item.GetOriginalUrl(),
+		})
+	}
+
+	userID, _ := auth.UserIDFromContext(ctx)
+	results, err := s.services.ShortenBatch(userID, items)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	resp := &pb.ShortenBatchResponse{Items: make([]*pb.ShortenBatchResponse_Item, 0, len(results))}
+	for _, result := range results {
+		resp.Items = append(resp.Items, &pb.ShortenBatchResponse_Item{
+			CorrelationId: result.CorrelationID,
+			ShortUrl:      result.ShortURL,
+		})
+	}
+	return resp, nil
+}
+
+// Expand does not count as a click, those are recorded for redirects only.
+func (s *Server) Expand(ctx context.Context, in *pb.ExpandRequest) (*pb.ExpandResponse, error) {
+	rec, err := s.services.Expand(in.GetId())
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &pb.ExpandResponse{OriginalUrl: rec.OriginalURL}, nil
+}
+
+func (s *Server) ListUserURLs(ctx context.Context, in *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	userID, _ := auth.UserIDFromContext(ctx)
+	urls, err := s.services.UserURLs(userID)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	resp := &pb.ListUserURLsResponse{Items: make([]*pb.ListUserURLsResponse_Item, 0, len(urls))}
+	for _, u := range urls {
+		resp.Items = append(resp.Items, &pb.ListUserURLsResponse_Item{
+			ShortUrl:    u.ShortURL,
+			OriginalUrl: u.OriginalURL,
+		})
+	}
+	return resp, nil
+}
+
+// Delete queues the deletion like DELETE /api/user/urls does.
+func (s *Server) Delete(ctx context.Context, in *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	userID, _ := auth.UserIDFromContext(ctx)
+	if err := s.services.DeleteURLs(userID, in.GetIds()); err != nil {
+		return nil, convertError(err)
+	}
+
+	return &pb.DeleteResponse{}, nil
+}
+
+// convertError maps the service errors to gRPC status codes.
+func convertError(err error) error {
+	var validationErr *service.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return status.Error(codes.InvalidArgument, validationErr.Error())
+	case errors.Is(err, service.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, service.ErrDeleted), errors.Is(err, service.ErrExpired):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, service.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		logger.Log.Error("gRPC call failed", zap.Error(err))
+		return status.Error(codes.Internal, "internal error")
+	}
+}
@@ -0,0 +1,159 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/grpcserver/pb"
+	"github.com/n1l/url-shortener/internal/service"
+	"github.com/n1l/url-shortener/internal/storage"
+)
+
+func newTestClient(t *testing.T) (pb.ShortenerClient, *storage.InMemoryStorage) {
+	options := config.Options{
+		PublicHost: "http://example.com",
+	}
+
+	store := storage.NewInMemoryStorage()
+	services := service.NewService(&options, store, store)
+	t.Cleanup(func() { services.Close() })
+
+	listener := bufconn.Listen(1 << 20)
+	server := NewServer(services, auth.NewAuthenticator("secret", auth.WithKeyStore(store)))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewShortenerClient(conn), store
+}
+
+func TestServer(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+
+	var header metadata.MD
+	resp, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "http://google.com"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/x7kg9X5V", resp.GetResult())
+	assert.False(t, resp.GetAlreadyExists())
+
+	tokens := header.Get(auth.CookieName)
+	require.Len(t, tokens, 1, "новый пользователь должен получить токен")
+	userCtx := metadata.AppendToOutgoingContext(ctx, auth.CookieName, tokens[0])
+
+	resp, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "http://google.com"})
+	require.NoError(t, err)
+	assert.True(t, resp.GetAlreadyExists())
+
+	_, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "google"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	batch, err := client.ShortenBatch(userCtx, &pb.ShortenBatchRequest{Items: []*pb.ShortenBatchRequest_Item{
+		{CorrelationId: "1", OriginalUrl: "http://yandex.ru"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.GetItems(), 1)
+	assert.Equal(t, "1", batch.GetItems()[0].GetCorrelationId())
+
+	expanded, err := client.Expand(ctx, &pb.ExpandRequest{Id: "x7kg9X5V"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://google.com", expanded.GetOriginalUrl())
+
+	_, err = client.Expand(ctx, &pb.ExpandRequest{Id: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListUserURLs(userCtx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.GetItems(), 2)
+
+	_, err = client.Delete(userCtx, &pb.DeleteRequest{Ids: []string{"x7kg9X5V"}})
+	require.NoError(t, err)
+
+	badCtx := metadata.AppendToOutgoingContext(ctx, auth.CookieName, "forged.token")
+	_, err = client.ListUserURLs(badCtx, &pb.ListUserURLsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "поддельный токен должен отклоняться")
+}
+
+func TestServerAPIKeys(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := context.Background()
+
+	newKey := func(scopes ...string) string {
+		token, key, err := auth.NewAPIKey("jobs", "", scopes)
+		require.NoError(t, err)
+		require.NoError(t, store.SaveAPIKey(key))
+		return token
+	}
+	shortenKey := newKey(auth.ScopeShorten)
+	deleteKey := newKey(auth.ScopeDelete)
+
+	var header metadata.MD
+	bearerCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+shortenKey)
+	_, err := client.Shorten(bearerCtx, &pb.ShortenRequest{Url: "http://google.com"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Empty(t, header.Get(auth.CookieName), "клиенту с ключом токен не нужен")
+
+	recs, err := store.GetByUser("jobs")
+	require.NoError(t, err)
+	assert.Len(t, recs, 1, "ссылка принадлежит аккаунту ключа")
+
+	_, err = client.Delete(bearerCtx, &pb.DeleteRequest{Ids: []string{"x7kg9X5V"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "без scope delete удалять нельзя")
+
+	headerCtx := metadata.AppendToOutgoingContext(ctx, "x-api-key", deleteKey)
+	_, err = client.Shorten(headerCtx, &pb.ShortenRequest{Url: "http://ya.ru"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "без scope shorten сокращать нельзя")
+
+	list, err := client.ListUserURLs(headerCtx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.GetItems(), 1)
+
+	_, err = client.Delete(headerCtx, &pb.DeleteRequest{Ids: []string{"x7kg9X5V"}})
+	assert.NoError(t, err)
+
+	badCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer garbage")
+	_, err = client.Expand(badCtx, &pb.ExpandRequest{Id: "x7kg9X5V"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "неверный ключ отклоняется")
+}
+
+func TestServerShortenOptions(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "http://google.com", Alias: "guarded", Interstitial: true})
+	require.NoError(t, err)
+
+	rec, err := store.Get("guarded")
+	require.NoError(t, err)
+	assert.True(t, rec.Interstitial, "ссылка показывает страницу предупреждения")
+
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "http://ya.ru", Alias: "moved", RedirectType: 301})
+	require.NoError(t, err)
+
+	rec, err = store.Get("moved")
+	require.NoError(t, err)
+	assert.Equal(t, 301, rec.RedirectType)
+
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "http://go.dev", RedirectType: 200})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "неверный код редиректа отклоняется")
+}
@@ -2,13 +2,72 @@ package hasher
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/base64"
+	"fmt"
+	"math/big"
 	"strings"
 )
 
+// Alphabet holds the characters short IDs consist of. All of them are
+// unreserved in URLs and need no escaping.
+const Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+const DefaultIDLength = 8
+
+// IDGenerator produces short IDs for original URLs. A non-zero attempt
+// asks for another ID after the previous one collided with a stored URL.
+type IDGenerator interface {
+	Generate(url string, length int, attempt int) string
+}
+
+func NewIDGenerator(kind string) (IDGenerator, error) {
+	switch kind {
+	case "", "hash":
+		return HashGenerator{}, nil
+	case "random":
+		return RandomGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id generator '%s'", kind)
+	}
+}
+
+// HashGenerator derives IDs from the MD5 of the URL, so the same URL
+// always gets the same ID unless it collides.
+type HashGenerator struct{}
+
+func (HashGenerator) Generate(url string, length int, attempt int) string {
+	seed := url
+	if attempt > 0 {
+		seed = fmt.Sprintf("%s#%d", url, attempt)
+	}
+
+	var sb strings.Builder
+	for sb.Len() < length {
+		sum := md5.Sum([]byte(seed))
+		seed = base64.RawURLEncoding.EncodeToString(sum[:])
+		sb.WriteString(seed)
+	}
+
+	return sb.String()[:length]
+}
+
+// RandomGenerator picks every character of an ID with crypto/rand.
+type RandomGenerator struct{}
+
+func (RandomGenerator) Generate(_ string, length int, _ int) string {
+	max := big.NewInt(int64(len(Alphabet)))
+	id := make([]byte, length)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		id[i] = Alphabet[n.Int64()]
+	}
+	return string(id)
+}
+
 func GetHashOfURL(url string) string {
-	sum := md5.Sum([]byte(url))
-	encoded := base64.StdEncoding.EncodeToString(sum[:])
-	hash := strings.Replace(encoded, "/", "", -1)[:8]
-	return hash
+	return HashGenerator{}.Generate(url, DefaultIDLength, 0)
 }
@@ -0,0 +1,35 @@
+package hasher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerators(t *testing.T) {
+	generators := map[string]IDGenerator{
+		"hash":   HashGenerator{},
+		"random": RandomGenerator{},
+	}
+
+	for name, gen := range generators {
+		t.Run(name, func(t *testing.T) {
+			for _, length := range []int{1, 8, 22, 23, 40} {
+				id := gen.Generate("http://eynt73dlmnjj3b.biz/t0pwb", length, 0)
+				assert.Len(t, id, length)
+				for _, c := range id {
+					assert.True(t, strings.ContainsRune(Alphabet, c), "unexpected character %q in %s", c, id)
+				}
+			}
+		})
+	}
+}
+
+func TestHashGeneratorAttempts(t *testing.T) {
+	gen := HashGenerator{}
+
+	assert.Equal(t, "x7kg9X5V", gen.Generate("http://google.com", 8, 0))
+	assert.Equal(t, gen.Generate("http://google.com", 8, 1), gen.Generate("http://google.com", 8, 1))
+	assert.NotEqual(t, gen.Generate("http://google.com", 8, 0), gen.Generate("http://google.com", 8, 1))
+}
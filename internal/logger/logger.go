@@ -1,10 +1,14 @@
 package logger
 
 import (
+	"context"
 	"net/http"
 	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 )
 
 type (
@@ -32,14 +36,17 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 
 var Log *zap.Logger = zap.NewNop()
 
+// atomicLevel is shared by all the loggers built by Initialize, so
+// SetLevel applies to them at once.
+var atomicLevel = zap.NewAtomicLevel()
+
 func Initialize(level string) error {
-	lvl, err := zap.ParseAtomicLevel(level)
-	if err != nil {
+	if err := SetLevel(level); err != nil {
 		return err
 	}
 
 	cfg := zap.NewProductionConfig()
-	cfg.Level = lvl
+	cfg.Level = atomicLevel
 	zl, err := cfg.Build()
 	if err != nil {
 		return err
@@ -49,33 +56,83 @@ func Initialize(level string) error {
 	return nil
 }
 
+// RequestObserver receives the outcome of a served HTTP request.
+type RequestObserver func(r *http.Request, status, size int, duration time.Duration)
+
+// SetLevel changes the level of Log on the fly.
+func SetLevel(name string) error {
+	lvl, err := zapcore.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	atomicLevel.SetLevel(lvl)
+	return nil
+}
+
 func RequestLoggerMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		Log.Debug("got incoming HTTP request",
-			zap.String("method", r.Method),
-			zap.String("path", r.URL.Path),
-		)
-
-		responseData := &responseData{
-			status: 0,
-			size:   0,
-		}
-		lw := loggingResponseWriter{
-			ResponseWriter: w,
-			responseData:   responseData,
-		}
-		start := time.Now()
-
-		h.ServeHTTP(&lw, r)
-
-		duration := time.Since(start)
-
-		Log.Debug("HTTP request served",
-			zap.String("uri", r.RequestURI),
-			zap.String("method", r.Method),
-			zap.Duration("duration", duration),
-			zap.Int("size", responseData.size),
-			zap.Int("status", responseData.status),
-		)
-	})
+	return RequestLogger()(h)
+}
+
+// RequestLogger logs the requests like RequestLoggerMiddleware and passes
+// the collected status, size and duration to the observers as well.
+func RequestLogger(observers ...RequestObserver) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Log.Debug("got incoming HTTP request",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+			)
+
+			responseData := &responseData{
+				status: 0,
+				size:   0,
+			}
+			lw := loggingResponseWriter{
+				ResponseWriter: w,
+				responseData:   responseData,
+			}
+			start := time.Now()
+
+			h.ServeHTTP(&lw, r)
+
+			duration := time.Since(start)
+
+			Log.Debug("HTTP request served",
+				zap.String("uri", r.RequestURI),
+				zap.String("method", r.Method),
+				zap.Duration("duration", duration),
+				zap.Int("size", responseData.size),
+				zap.Int("status", responseData.status),
+			)
+
+			status := responseData.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			for _, observe := range observers {
+				observe(r, status, responseData.size, duration)
+			}
+		})
+	}
+}
+
+// UnaryServerInterceptor is the gRPC counterpart of RequestLoggerMiddleware.
+func UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	Log.Debug("got incoming gRPC request",
+		zap.String("method", info.FullMethod),
+	)
+
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	duration := time.Since(start)
+
+	Log.Debug("gRPC request served",
+		zap.String("method", info.FullMethod),
+		zap.Duration("duration", duration),
+		zap.String("code", status.Code(err).String()),
+	)
+
+	return resp, err
 }
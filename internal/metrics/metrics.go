@@ -0,0 +1,113 @@
+// Package metrics holds the Prometheus collectors of the service, they
+// are registered with the default registry and served by Handler.
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+)
+
+const namespace = "shortener"
+
+// Redirect results.
+const (
+	RedirectServed   = "served"
+	RedirectNotFound = "not_found"
+	RedirectGone     = "gone"
+	RedirectPreview  = "preview"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latencies by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	redirects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirects_total",
+		Help:      "Short link lookups by result: served, not_found or gone.",
+	}, []string{"result"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Storage operation latencies.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"operation"})
+
+	gzipRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gzip_compression_ratio",
+		Help:      "Compressed to uncompressed size ratio of gzipped responses.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+	})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest counts the request served by a chi router, it is meant
+// to be passed to logger.RequestLogger.
+func ObserveRequest(r *http.Request, status, _ int, duration time.Duration) {
+	route := "unmatched"
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+
+	labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+	httpRequests.With(labels).Inc()
+	httpDuration.With(labels).Observe(duration.Seconds())
+}
+
+func ObserveRedirect(result string) {
+	redirects.WithLabelValues(result).Inc()
+}
+
+// ObserveStorage records the latency of the storage operation started
+// at start.
+func ObserveStorage(operation string, start time.Time) {
+	storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func ObserveGzip(uncompressed, compressed int64) {
+	if uncompressed > 0 {
+		gzipRatio.Observe(float64(compressed) / float64(uncompressed))
+	}
+}
+
+// RegisterStoredLinks exposes the number of stored links, count is called
+// on every scrape.
+func RegisterStoredLinks(count func() (int, error)) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stored_links",
+		Help:      "Number of links in the storage.",
+	}, func() float64 {
+		n, err := count()
+		if err != nil {
+			logger.Log.Error("failed to count stored links", zap.Error(err))
+			return math.NaN()
+		}
+		return float64(n)
+	}))
+}
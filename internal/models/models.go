@@ -1,14 +1,108 @@
 package models
 
+import "time"
+
 type CreateShortenRequest struct {
-	URL string `json:"url"`
+	URL          string     `json:"url"`
+	Alias        string     `json:"alias,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds   int64      `json:"ttl_seconds,omitempty"`
+	Interstitial bool       `json:"interstitial,omitempty"`
+	RedirectType int        `json:"redirect_type,omitempty"`
 }
 
 type CreateShortenResponse struct {
 	URL string `json:"result"`
 }
 
-type URLRecord struct {
+type CreateShortenBatchRequestItem struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+}
+
+type CreateShortenBatchResponseItem struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url"`
+}
+
+type UserURLResponseItem struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
 }
+
+// URLRecord is a short link. CreatedAt is zero for the links created
+// before it was recorded, Interstitial links always show the preview page
+// before redirecting. RedirectType is the redirect status, zero for the
+// configured default.
+type URLRecord struct {
+	ShortURL     string     `json:"short_url"`
+	OriginalURL  string     `json:"original_url"`
+	UserID       string     `json:"user_id,omitempty"`
+	DeletedFlag  bool       `json:"is_deleted,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Interstitial bool       `json:"interstitial,omitempty"`
+	RedirectType int        `json:"redirect_type,omitempty"`
+}
+
+func (r *URLRecord) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// APIKey is stored without its secret, Hash is the SHA-256 of the secret.
+// The links created with the key belong to UserID.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type DeletionRequest struct {
+	UserID   string
+	ShortURL string
+}
+
+type Click struct {
+	ShortURL    string    `json:"short_url"`
+	Time        time.Time `json:"time"`
+	Referrer    string    `json:"referrer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	VisitorHash string    `json:"visitor_hash"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+// ErrorResponse explains a rejected request, Reason is a stable code for
+// programs and Error a message for people.
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type InternalStats struct {
+	URLs  int `json:"urls"`
+	Users int `json:"users"`
+}
+
+type LinkStats struct {
+	ShortURL       string        `json:"short_url"`
+	TotalClicks    int           `json:"total_clicks"`
+	UniqueVisitors int           `json:"unique_visitors"`
+	Daily          []DailyClicks `json:"daily"`
+}
@@ -0,0 +1,126 @@
+// Package qr renders QR codes as PNG and SVG images.
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Options describe the image. Size is the width and height in pixels,
+// Margin the quiet zone around the code in modules, Level the error
+// correction level: L, M, Q or H.
+type Options struct {
+	Size   int
+	Margin int
+	Level  string
+}
+
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// ValidLevel reports whether the error correction level is known.
+func ValidLevel(level string) bool {
+	_, ok := levels[strings.ToUpper(level)]
+	return ok
+}
+
+// modules returns the code with the requested margin around it.
+func modules(content string, opts Options) ([][]bool, error) {
+	level, ok := levels[strings.ToUpper(opts.Level)]
+	if !ok {
+		return nil, fmt.Errorf("unknown error correction level '%s'", opts.Level)
+	}
+
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	n := len(bitmap) + 2*opts.Margin
+	out := make([][]bool, n)
+	for y := range out {
+		out[y] = make([]bool, n)
+		if y >= opts.Margin && y < opts.Margin+len(bitmap) {
+			copy(out[y][opts.Margin:], bitmap[y-opts.Margin])
+		}
+	}
+	return out, nil
+}
+
+// PNG draws every module as a square of whole pixels, the image is
+// centered and padded to the size, or made larger if the code does not
+// fit.
+func PNG(content string, opts Options) ([]byte, error) {
+	bitmap, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(bitmap)
+	scale := max(opts.Size/n, 1)
+	size := max(opts.Size, n*scale)
+	offset := (size - n*scale) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG draws the dark modules as a single path, a run of modules in a row
+// is a single rectangle.
+func SVG(content string, opts Options) ([]byte, error) {
+	bitmap, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(bitmap)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.Size, opts.Size, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPNG(t *testing.T) {
+	data, err := PNG("http://localhost:8080/x7kg9X5V", Options{Size: 256, Margin: 4, Level: "M"})
+	require.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 256, img.Bounds().Dx())
+	assert.Equal(t, 256, img.Bounds().Dy())
+
+	isBlack := func(x, y int) bool {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r == 0
+	}
+	assert.False(t, isBlack(0, 0), "поле вокруг кода белое")
+
+	data, err = PNG("http://localhost:8080/x7kg9X5V", Options{Size: 100, Margin: 0, Level: "h"})
+	require.NoError(t, err)
+	img, err = png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	bitmap, err := modules("http://localhost:8080/x7kg9X5V", Options{Level: "H"})
+	require.NoError(t, err)
+	n := len(bitmap)
+	offset := (100 - 100/n*n) / 2
+	assert.Equal(t, color.Gray16{}, color.Gray16Model.Convert(img.At(offset, offset)), "без поля угол кода чёрный")
+
+	bitmap, err = modules("http://localhost:8080/x7kg9X5V", Options{Margin: 4, Level: "L"})
+	require.NoError(t, err)
+	data, err = PNG("http://localhost:8080/x7kg9X5V", Options{Size: 10, Margin: 4, Level: "L"})
+	require.NoError(t, err)
+	img, err = png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, len(bitmap), img.Bounds().Dx(), "слишком маленький размер увеличивается до размера кода")
+}
+
+func TestSVG(t *testing.T) {
+	data, err := SVG("http://localhost:8080/x7kg9X5V", Options{Size: 300, Margin: 2, Level: "Q"})
+	require.NoError(t, err)
+
+	bitmap, err := modules("http://localhost:8080/x7kg9X5V", Options{Margin: 2, Level: "Q"})
+	require.NoError(t, err)
+
+	svg := string(data)
+	assert.True(t, strings.HasPrefix(svg, "<svg "))
+	assert.Contains(t, svg, `width="300"`)
+	assert.Contains(t, svg, fmt.Sprintf(`viewBox="0 0 %d %d"`, len(bitmap), len(bitmap)))
+	assert.Contains(t, svg, "M2 2h7v1h-7z", "верхний ряд поискового узора")
+}
+
+func TestLevel(t *testing.T) {
+	assert.True(t, ValidLevel("m"))
+	assert.False(t, ValidLevel("X"))
+
+	_, err := PNG("http://localhost", Options{Size: 100, Level: "X"})
+	assert.Error(t, err)
+}
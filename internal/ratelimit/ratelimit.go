@@ -0,0 +1,129 @@
+// Package ratelimit implements token buckets kept per client key.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit lets a client make Burst requests at once and refills the bucket
+// with Rate tokens per second. A zero rate disables the limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// Result describes the bucket of a client after a request.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the time until the next token, zero when allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a bucket per key. Buckets not used for the idle time are
+// dropped, so the memory is bounded by the number of recently active
+// clients.
+type Limiter struct {
+	lock      sync.Mutex
+	limit     Limit
+	idle      time.Duration
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func New(limit Limit, idle time.Duration) *Limiter {
+	return &Limiter{
+		limit:     limit,
+		idle:      idle,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// SetLimit changes the limit of all the clients, the tokens above the
+// new burst are taken away.
+func (l *Limiter) SetLimit(limit Limit, idle time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limit = limit
+	l.idle = idle
+	for _, b := range l.buckets {
+		b.tokens = math.Min(b.tokens, float64(limit.Burst))
+	}
+}
+
+// Allow takes a token from the bucket of the key.
+func (l *Limiter) Allow(key string) Result {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.limit.Enabled() {
+		return Result{Allowed: true}
+	}
+
+	now := l.now()
+	l.sweep(now)
+
+	burst := float64(l.limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	res := Result{Limit: l.limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.duration(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = l.duration(burst - b.tokens)
+	return res
+}
+
+// Len returns the number of buckets kept.
+func (l *Limiter) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.buckets)
+}
+
+// sweep drops the idle buckets, at most once per idle time.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idle {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *Limiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.limit.Rate * float64(time.Second))
+}
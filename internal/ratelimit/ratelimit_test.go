@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newLimiter(limit Limit, idle time.Duration) (*Limiter, *clock) {
+	c := &clock{now: time.Now()}
+	l := New(limit, idle)
+	l.now = c.Now
+	l.lastSweep = c.now
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	l, c := newLimiter(Limit{Rate: 2, Burst: 3}, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		res := l.Allow("a")
+		assert.True(t, res.Allowed, "запрос %d в пределах burst", i)
+		assert.Equal(t, 2-i, res.Remaining)
+	}
+
+	res := l.Allow("a")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 3, res.Limit)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, res.Reset)
+
+	assert.True(t, l.Allow("b").Allowed, "у каждого клиента своя корзина")
+
+	c.now = c.now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow("a").Allowed, "токен восстанавливается со скоростью rate")
+	assert.False(t, l.Allow("a").Allowed)
+
+	c.now = c.now.Add(time.Hour)
+	assert.Equal(t, 2, l.Allow("a").Remaining, "корзина не переполняется сверх burst")
+}
+
+func TestDisabled(t *testing.T) {
+	l, _ := newLimiter(Limit{}, time.Minute)
+	for i := 0; i < 100; i++ {
+		assert.True(t, l.Allow("a").Allowed)
+	}
+	assert.Equal(t, 0, l.Len())
+}
+
+func TestSetLimit(t *testing.T) {
+	l, _ := newLimiter(Limit{Rate: 1, Burst: 10}, time.Minute)
+	l.Allow("a")
+
+	l.SetLimit(Limit{Rate: 1, Burst: 2}, time.Minute)
+	res := l.Allow("a")
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining, "лишние токены снимаются при уменьшении burst")
+}
+
+func TestSweep(t *testing.T) {
+	l, c := newLimiter(Limit{Rate: 1, Burst: 1}, time.Minute)
+	l.Allow("a")
+	l.Allow("b")
+	assert.Equal(t, 2, l.Len())
+
+	c.now = c.now.Add(30 * time.Second)
+	l.Allow("b")
+	assert.Equal(t, 2, l.Len())
+
+	c.now = c.now.Add(40 * time.Second)
+	l.Allow("c")
+	assert.Equal(t, 2, l.Len(), "простаивающая корзина удаляется")
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/n1l/url-shortener/internal/hasher"
+)
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
+// reservedAliases are the first path segments routed to something other
+// than a short link.
+var reservedAliases = map[string]struct{}{
+	"api":     {},
+	"ping":    {},
+	"healthz": {},
+	"readyz":  {},
+	"metrics": {},
+}
+
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("alias must be from %d to %d characters long", minAliasLength, maxAliasLength)
+	}
+
+	if i := strings.IndexFunc(alias, func(c rune) bool { return !strings.ContainsRune(hasher.Alphabet, c) }); i >= 0 {
+		return fmt.Errorf("alias contains forbidden character %q, only latin letters, digits, '-' and '_' are allowed", alias[i])
+	}
+
+	if _, ok := reservedAliases[strings.ToLower(alias)]; ok {
+		return errors.New("alias is reserved")
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher merges the items queued by many goroutines into batches and
+// passes them to flush when a batch is full, every interval and on close.
+type batcher[T any] struct {
+	lock   sync.RWMutex
+	closed bool
+	queue  chan []T
+	done   chan struct{}
+}
+
+func newBatcher[T any](queueSize int, batchSize int, interval time.Duration, flush func([]T)) *batcher[T] {
+	b := &batcher[T]{
+		queue: make(chan []T, queueSize),
+		done:  make(chan struct{}),
+	}
+
+	go b.run(batchSize, interval, flush)
+
+	return b
+}
+
+// add queues the items, waiting for room in the queue if it is full.
+// It reports false if the batcher has been closed.
+func (b *batcher[T]) add(items ...T) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return false
+	}
+	b.queue <- items
+	return true
+}
+
+// tryAdd queues the items unless the queue is full or the batcher has
+// been closed and reports whether they have been queued.
+func (b *batcher[T]) tryAdd(items ...T) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return false
+	}
+	select {
+	case b.queue <- items:
+		return true
+	default:
+		return false
+	}
+}
+
+// close flushes the queued items and stops the batcher, the items added
+// afterwards are dropped.
+func (b *batcher[T]) close() {
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.lock.Unlock()
+	<-b.done
+}
+
+func (b *batcher[T]) run(batchSize int, interval time.Duration, flush func([]T)) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []T
+	flushBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		flush(batch)
+		batch = nil
+	}
+
+	for {
+		select {
+		case items, ok := <-b.queue:
+			if !ok {
+				flushBatch()
+				return
+			}
+			batch = append(batch, items...)
+			if len(batch) >= batchSize {
+				flushBatch()
+			}
+		case <-ticker.C:
+			flushBatch()
+		}
+	}
+}
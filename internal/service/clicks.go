@@ -0,0 +1,82 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+const (
+	clickQueueSize     = 4096
+	clickBatchSize     = 500
+	clickFlushInterval = time.Second
+)
+
+func (s *Service) newClickRecorder() *batcher[models.Click] {
+	return newBatcher(clickQueueSize, clickBatchSize, clickFlushInterval, func(clicks []models.Click) {
+		if err := s.URLSaver.SaveClicks(clicks); err != nil {
+			logger.Log.Error("failed to save clicks", zap.Int("count", len(clicks)), zap.Error(err))
+		}
+	})
+}
+
+// recordClick queues the redirect for the statistics without waiting,
+// the click is dropped if the recorder falls behind.
+func (s *Service) recordClick(r *http.Request, shortURL string) {
+	click := models.Click{
+		ShortURL:    shortURL,
+		Time:        time.Now().UTC(),
+		Referrer:    r.Referer(),
+		UserAgent:   r.UserAgent(),
+		VisitorHash: s.visitorHash(s.ClientIP(r)),
+	}
+
+	if !s.clicks.tryAdd(click) {
+		logger.Log.Warn("click recorder is busy, dropping click", zap.String("id", shortURL))
+	}
+}
+
+// visitorHash keeps client IPs out of storage while still telling unique
+// visitors apart.
+func (s *Service) visitorHash(ip string) string {
+	sum := sha256.Sum256([]byte(s.VisitorSalt + ip))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP returns the address of the client: the X-Real-IP header when
+// the request comes from a trusted proxy, the remote address of the
+// connection otherwise, since anybody can send the header.
+func (s *Service) ClientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	if ip := r.Header.Get("X-Real-IP"); ip != "" && s.trustedProxy(peer) {
+		return ip
+	}
+	return peer
+}
+
+func (s *Service) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, proxy := range s.opts().TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+const (
+	deleteQueueSize     = 1024
+	deleteBatchSize     = 100
+	deleteFlushInterval = time.Second
+)
+
+func (s *Service) newDeleter() *batcher[models.DeletionRequest] {
+	return newBatcher(deleteQueueSize, deleteBatchSize, deleteFlushInterval, func(reqs []models.DeletionRequest) {
+		if err := s.URLSaver.MarkDeleted(reqs); err != nil {
+			logger.Log.Error("failed to delete urls", zap.Int("count", len(reqs)), zap.Error(err))
+		}
+	})
+}
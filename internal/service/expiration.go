@@ -0,0 +1,34 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+const maxTTLSeconds = math.MaxInt64 / int64(time.Second)
+
+// expirationOf returns the moment the requested link stops working or
+// nil if it never expires.
+func expirationOf(req *models.CreateShortenRequest, now time.Time) (*time.Time, error) {
+	switch {
+	case req.ExpiresAt != nil && req.TTLSeconds != 0:
+		return nil, errors.New("only one of expires_at and ttl_seconds may be set")
+	case req.TTLSeconds < 0 || req.TTLSeconds > maxTTLSeconds:
+		return nil, fmt.Errorf("ttl_seconds must be from 1 to %d", maxTTLSeconds)
+	case req.TTLSeconds > 0:
+		expiresAt := now.Add(time.Duration(req.TTLSeconds) * time.Second).UTC()
+		return &expiresAt, nil
+	case req.ExpiresAt != nil:
+		if !req.ExpiresAt.After(now) {
+			return nil, errors.New("expires_at must be in the future")
+		}
+		expiresAt := req.ExpiresAt.UTC()
+		return &expiresAt, nil
+	default:
+		return nil, nil
+	}
+}
@@ -2,14 +2,20 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/n1l/url-shortener/internal/hasher"
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/metrics"
 	"github.com/n1l/url-shortener/internal/models"
+	"github.com/n1l/url-shortener/internal/storage"
 )
 
 func (s *Service) GetURLByHashHandler(w http.ResponseWriter, r *http.Request) {
@@ -20,15 +26,38 @@ func (s *Service) GetURLByHashHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlGetter := s.URLGetter
 	hashID := chi.URLParam(r, parameterName)
 
-	if url, ok := urlGetter.Get(hashID); ok {
-		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	rec, err := s.Expand(hashID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		metrics.ObserveRedirect(metrics.RedirectNotFound)
+		http.Error(w, fmt.Sprintf("Bad Request! id: '%s' not found", hashID), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrDeleted):
+		metrics.ObserveRedirect(metrics.RedirectGone)
+		http.Error(w, fmt.Sprintf("Gone! id: '%s' has been deleted", hashID), http.StatusGone)
+		return
+	case errors.Is(err, ErrExpired):
+		metrics.ObserveRedirect(metrics.RedirectGone)
+		http.Error(w, fmt.Sprintf("Gone! id: '%s' has expired", hashID), http.StatusGone)
+		return
+	case errors.Is(err, ErrUnavailable):
+		http.Error(w, "Service Unavailable!", http.StatusServiceUnavailable)
 		return
 	}
 
-	http.Error(w, fmt.Sprintf("Bad Request! id: '%s' not found", hashID), http.StatusBadRequest)
+	if wantsPreview(r, rec) {
+		s.writePreview(w, rec)
+		return
+	}
+
+	code := s.redirectCode(rec)
+	w.Header().Set("Cache-Control", redirectCacheControl(code, rec, time.Now()))
+
+	metrics.ObserveRedirect(metrics.RedirectServed)
+	http.Redirect(w, r, rec.OriginalURL, code)
+	s.recordClick(r, rec.ShortURL)
 }
 
 func (s *Service) CreateShortedURLHandler(w http.ResponseWriter, r *http.Request) {
@@ -44,60 +73,152 @@ func (s *Service) CreateShortedURLHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	stringURI := string(body)
-	if _, parseErr := url.ParseRequestURI(stringURI); parseErr != nil {
-		http.Error(w, "Bad Request!"+" "+parseErr.Error(), http.StatusBadRequest)
+	userID, _ := auth.UserIDFromContext(r.Context())
+	rec, status, ok := s.shorten(w, userID, &models.CreateShortenRequest{URL: string(body)}, rejectText)
+	if !ok {
 		return
 	}
 
-	ops := s.Options
-	urlSaver := s.URLSaver
-	hashID := hasher.GetHashOfURL(stringURI)
+	w.WriteHeader(status)
+	w.Write([]byte(s.ShortURL(rec.ShortURL)))
+}
 
-	rec := &models.URLRecord{
-		ShortURL:    hashID,
-		OriginalURL: stringURI,
+func (s *Service) CreateShortedURLfromJSONHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "Bad Request!", http.StatusBadRequest)
+		return
 	}
-	urlSaver.Save(rec)
 
-	resultStr := fmt.Sprintf("%s/%s", ops.PublicHost, hashID)
+	var req models.CreateShortenRequest
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&req); err != nil {
+		rejectJSON(w, &ValidationError{Reason: ReasonInvalidRequest, Err: fmt.Errorf("malformed JSON: %w", err)})
+		return
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(resultStr))
+	userID, _ := auth.UserIDFromContext(r.Context())
+	rec, status, ok := s.shorten(w, userID, &req, rejectJSON)
+	if !ok {
+		return
+	}
+
+	resp := models.CreateShortenResponse{
+		URL: s.ShortURL(rec.ShortURL),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
-func (s *Service) CreateShortedURLfromJSONHandler(w http.ResponseWriter, r *http.Request) {
+// shorten calls Shorten and answers the errors it returns, the rejected
+// requests with reject. It reports the record to respond with and its
+// status, ok is false when the response has already been written.
+func (s *Service) shorten(w http.ResponseWriter, userID string, req *models.CreateShortenRequest, reject func(http.ResponseWriter, *ValidationError)) (*models.URLRecord, int, bool) {
+	rec, err := s.Shorten(userID, req)
+
+	var validationErr *ValidationError
+	var existsErr *storage.AlreadyExistsError
+	var takenErr *storage.IDTakenError
+	switch {
+	case err == nil:
+		return rec, http.StatusCreated, true
+	case errors.As(err, &existsErr):
+		return existsErr.Existing, http.StatusConflict, true
+	case errors.As(err, &validationErr):
+		reject(w, validationErr)
+	case errors.As(err, &takenErr):
+		http.Error(w, fmt.Sprintf("Conflict! alias '%s' is already taken", req.Alias), http.StatusConflict)
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+	return nil, 0, false
+}
+
+func rejectText(w http.ResponseWriter, err *ValidationError) {
+	http.Error(w, "Bad Request!"+" "+err.Error(), http.StatusBadRequest)
+}
+
+// rejectJSON explains the rejection to the JSON API clients.
+func rejectJSON(w http.ResponseWriter, err *ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+
+	enc := json.NewEncoder(w)
+	if encErr := enc.Encode(models.ErrorResponse{Error: err.Error(), Reason: err.Reason}); encErr != nil {
+		// the status is sent already, the client gets a cut body
+		logger.Log.Error("failed to write rejection", zap.String("reason", err.Reason), zap.Error(encErr))
+	}
+}
+
+func (s *Service) CreateShortedURLBatchHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	if r.Method != http.MethodPost {
 		http.Error(w, "Bad Request!", http.StatusBadRequest)
 		return
 	}
 
-	var req models.CreateShortenRequest
+	var req []models.CreateShortenBatchRequestItem
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "Bad Request!"+" "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := auth.UserIDFromContext(r.Context())
+	resp, err := s.ShortenBatch(userID, req)
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		rejectJSON(w, validationErr)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
 
-	ops := s.Options
-	urlSaver := s.URLSaver
-	hashID := hasher.GetHashOfURL(req.URL)
+func (s *Service) GetUserURLsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Bad Request!", http.StatusBadRequest)
+		return
+	}
 
-	rec := &models.URLRecord{
-		ShortURL:    hashID,
-		OriginalURL: req.URL,
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
-	urlSaver.Save(rec)
 
-	resultStr := fmt.Sprintf("%s/%s", ops.PublicHost, hashID)
+	resp, err := s.UserURLs(userID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
-	resp := models.CreateShortenResponse{
-		URL: resultStr,
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusOK)
 
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(resp); err != nil {
@@ -105,3 +226,100 @@ func (s *Service) CreateShortedURLfromJSONHandler(w http.ResponseWriter, r *http
 		return
 	}
 }
+
+func (s *Service) DeleteUserURLsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Bad Request!", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var ids []string
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&ids); err != nil {
+		http.Error(w, "Bad Request!"+" "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DeleteURLs(userID, ids); err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// GetURLHandler answers the original URL of the link as JSON. Unlike the
+// redirect it is not counted as a click.
+func (s *Service) GetURLHandler(w http.ResponseWriter, r *http.Request) {
+	const parameterName = "id"
+
+	hashID := chi.URLParam(r, parameterName)
+
+	rec, err := s.Expand(hashID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, fmt.Sprintf("Not Found! id: '%s' not found", hashID), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrDeleted), errors.Is(err, ErrExpired):
+		http.Error(w, fmt.Sprintf("Gone! id: '%s' is no longer available", hashID), http.StatusGone)
+		return
+	case errors.Is(err, ErrUnavailable):
+		http.Error(w, "Service Unavailable!", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(models.UserURLResponseItem{ShortURL: s.ShortURL(rec.ShortURL), OriginalURL: rec.OriginalURL}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetURLStatsHandler answers the click statistics to the owner of the
+// link only, the links of other users are not found.
+func (s *Service) GetURLStatsHandler(w http.ResponseWriter, r *http.Request) {
+	const parameterName = "id"
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Bad Request!", http.StatusBadRequest)
+		return
+	}
+
+	hashID := chi.URLParam(r, parameterName)
+	userID, _ := auth.UserIDFromContext(r.Context())
+	rec, err := s.URLGetter.Get(hashID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger.Log.Error("failed to get url", zap.String("id", hashID), zap.Error(err))
+		http.Error(w, "Service Unavailable!", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || rec.UserID == "" || rec.UserID != userID {
+		http.Error(w, fmt.Sprintf("Not Found! id: '%s' not found", hashID), http.StatusNotFound)
+		return
+	}
+
+	stats, err := s.URLGetter.GetClickStats(hashID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(stats); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+)
+
+// SetReady switches the answer of ReadyzHandler. main clears it on
+// shutdown, so load balancers stop sending traffic before the server
+// stops accepting it.
+func (s *Service) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// PingHandler answers 200 when the storage is reachable.
+func (s *Service) PingHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.URLGetter.Ping(r.Context()); err != nil {
+		logger.Log.Error("storage ping failed", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HealthzHandler answers 200 as long as the process serves requests.
+func (s *Service) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// ReadyzHandler answers 200 when the instance accepts new traffic: it is
+// not shutting down and the storage is reachable.
+func (s *Service) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "Service Unavailable! shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := s.URLGetter.Ping(r.Context()); err != nil {
+		logger.Log.Error("storage ping failed", zap.Error(err))
+		http.Error(w, "Service Unavailable! storage is unreachable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,11 +1,28 @@
 package service
 
-import "github.com/n1l/url-shortener/internal/models"
+import (
+	"context"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
 
 type URLSaver interface {
 	Save(rec *models.URLRecord) error
+	SaveBatch(recs []*models.URLRecord) error
+	MarkDeleted(reqs []models.DeletionRequest) error
+	SaveClicks(clicks []models.Click) error
 }
 
 type URLGetter interface {
-	Get(hash string) (string, bool)
+	// Get returns storage.ErrNotFound when no record has the short URL.
+	Get(hash string) (*models.URLRecord, error)
+	GetByUser(userID string) ([]*models.URLRecord, error)
+	GetClickStats(hash string) (*models.LinkStats, error)
+	// CountURLs returns the number of working links, not the deleted or
+	// expired ones.
+	CountURLs(ctx context.Context) (int, error)
+	// CountUsers returns the number of distinct owners of the stored records.
+	CountUsers(ctx context.Context) (int, error)
+	// Ping reports whether the storage is able to serve requests.
+	Ping(ctx context.Context) error
 }
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// TrustedSubnetMiddleware lets through only the clients from the trusted
+// subnet, nobody when it is not configured. The X-Real-IP header counts
+// only when set by a trusted proxy.
+func (s *Service) TrustedSubnetMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.trusted(s.ClientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Service) trusted(ip string) bool {
+	subnet := s.opts().TrustedSubnet
+	if subnet == "" {
+		return false
+	}
+
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return prefix.Contains(addr.Unmap())
+}
+
+func (s *Service) GetInternalStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Bad Request!", http.StatusBadRequest)
+		return
+	}
+
+	urls, err := s.URLGetter.CountURLs(r.Context())
+	if err != nil {
+		logger.Log.Error("failed to count urls", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	users, err := s.URLGetter.CountUsers(r.Context())
+	if err != nil {
+		logger.Log.Error("failed to count users", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(models.InternalStats{URLs: urls, Users: users}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
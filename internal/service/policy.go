@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The reasons of ValidationError, the JSON API reports them to clients.
+const (
+	ReasonInvalidRequest      = "invalid_request"
+	ReasonInvalidURL          = "invalid_url"
+	ReasonSchemeNotAllowed    = "scheme_not_allowed"
+	ReasonDomainBlocked       = "domain_blocked"
+	ReasonSelfReference       = "self_reference"
+	ReasonInvalidAlias        = "invalid_alias"
+	ReasonInvalidExpiration   = "invalid_expiration"
+	ReasonInvalidRedirectType = "invalid_redirect_type"
+)
+
+var defaultSchemes = []string{"http", "https"}
+
+// Blocklist holds the domains the service refuses to shorten links to,
+// a domain blocks its subdomains as well.
+type Blocklist struct {
+	domains map[string]struct{}
+}
+
+// LoadBlocklist reads the domains from the file, one per line. Empty
+// lines and lines starting with # are skipped, a leading "*." or "." is
+// ignored. No file means an empty blocklist.
+func LoadBlocklist(filename string) (*Blocklist, error) {
+	b := &Blocklist{domains: make(map[string]struct{})}
+	if filename == "" {
+		return b, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(strings.TrimPrefix(line, "*"), ".")
+		b.domains[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %w", err)
+	}
+
+	return b, nil
+}
+
+// Blocked reports whether the host or any of its parent domains is
+// blocked.
+func (b *Blocklist) Blocked(host string) bool {
+	if b == nil {
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for {
+		if _, ok := b.domains[host]; ok {
+			return true
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			return false
+		}
+		host = parent
+	}
+}
+
+// Len returns the number of blocked domains.
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.domains)
+}
+
+// ValidateURL checks the URL against the safety policy: it must be an
+// absolute URL with an allowed scheme, not point to a blocked domain and
+// not point back to the shortener.
+func (s *Service) ValidateURL(raw string) error {
+	u, err := url.ParseRequestURI(raw)
+	if err != nil {
+		return &ValidationError{Reason: ReasonInvalidURL, Err: err}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	schemes := s.opts().AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = defaultSchemes
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return &ValidationError{Reason: ReasonSchemeNotAllowed, Err: fmt.Errorf("scheme '%s' is not allowed, use one of %s", u.Scheme, strings.Join(schemes, ", "))}
+	}
+
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host == "" {
+		return &ValidationError{Reason: ReasonInvalidURL, Err: errors.New("url has no host")}
+	}
+
+	if s.blocklist.Load().Blocked(u.Hostname()) {
+		return &ValidationError{Reason: ReasonDomainBlocked, Err: fmt.Errorf("domain '%s' is blocked", u.Hostname())}
+	}
+
+	if public, err := url.Parse(s.opts().PublicHost); err == nil && sameHost(u, public) {
+		return &ValidationError{Reason: ReasonSelfReference, Err: errors.New("links to the shortener itself are not allowed")}
+	}
+
+	return nil
+}
+
+// sameHost compares the hosts of the URLs, taking the default ports of
+// their schemes into account.
+func sameHost(a, b *url.URL) bool {
+	if !strings.EqualFold(strings.TrimSuffix(a.Hostname(), "."), strings.TrimSuffix(b.Hostname(), ".")) {
+		return false
+	}
+	return portOf(a) == portOf(b)
+}
+
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/metrics"
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+const previewTimeLayout = "2006-01-02 15:04 UTC"
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link preview</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 3em auto; padding: 0 1em; color: #222; }
+.destination { word-break: break-all; font-family: monospace; padding: .5em; background: #f4f4f4; }
+dt { font-weight: bold; margin-top: .5em; }
+a.continue { display: inline-block; margin-top: 1.5em; padding: .6em 1.2em; background: #0b5fff; color: #fff; text-decoration: none; border-radius: 4px; }
+</style>
+</head>
+<body>
+<h1>This link leads to</h1>
+<p class="destination">{{.Destination}}</p>
+<dl>
+<dt>Short link</dt><dd>{{.ShortURL}}</dd>
+<dt>Created</dt><dd>{{.Created}}</dd>
+{{if .Expires}}<dt>Expires</dt><dd>{{.Expires}}</dd>
+{{end}}<dt>Clicks</dt><dd>{{.Clicks}}</dd>
+</dl>
+<a class="continue" href="{{.ContinueURL}}" rel="noreferrer">Continue to the destination</a>
+</body>
+</html>
+`))
+
+type previewPage struct {
+	Destination string
+	ShortURL    string
+	Created     string
+	Expires     string
+	Clicks      string
+	ContinueURL string
+}
+
+// GetPreviewHandler answers the preview page of the link at /{id}+
+// instead of redirecting.
+func (s *Service) GetPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	const parameterName = "id"
+
+	hashID := chi.URLParam(r, parameterName)
+
+	rec, err := s.Expand(hashID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		metrics.ObserveRedirect(metrics.RedirectNotFound)
+		http.Error(w, fmt.Sprintf("Not Found! id: '%s' not found", hashID), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrDeleted), errors.Is(err, ErrExpired):
+		metrics.ObserveRedirect(metrics.RedirectGone)
+		http.Error(w, fmt.Sprintf("Gone! id: '%s' is no longer available", hashID), http.StatusGone)
+		return
+	case errors.Is(err, ErrUnavailable):
+		http.Error(w, "Service Unavailable!", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.writePreview(w, rec)
+}
+
+// writePreview renders the page showing where the link leads. Its
+// continue button follows the short link with confirm=1, so the click is
+// recorded and the interstitial is not shown again.
+func (s *Service) writePreview(w http.ResponseWriter, rec *models.URLRecord) {
+	page := previewPage{
+		Destination: rec.OriginalURL,
+		ShortURL:    s.ShortURL(rec.ShortURL),
+		Created:     "unknown",
+		Clicks:      "unknown",
+		ContinueURL: s.ShortURL(rec.ShortURL) + "?confirm=1",
+	}
+	if !rec.CreatedAt.IsZero() {
+		page.Created = rec.CreatedAt.UTC().Format(previewTimeLayout)
+	}
+	if rec.ExpiresAt != nil {
+		page.Expires = rec.ExpiresAt.UTC().Format(previewTimeLayout)
+	}
+
+	// the page is still useful without the statistics
+	if stats, err := s.URLGetter.GetClickStats(rec.ShortURL); err == nil {
+		page.Clicks = strconv.Itoa(stats.TotalClicks)
+	} else {
+		logger.Log.Error("failed to get click stats", zap.String("id", rec.ShortURL), zap.Error(err))
+	}
+
+	var buf bytes.Buffer
+	if err := previewTemplate.Execute(&buf, page); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	metrics.ObserveRedirect(metrics.RedirectPreview)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// wantsPreview reports whether the redirect should show the preview page:
+// when asked with preview=1 or for interstitial links not yet confirmed.
+func wantsPreview(r *http.Request, rec *models.URLRecord) bool {
+	query := r.URL.Query()
+	return query.Get("preview") == "1" || (rec.Interstitial && query.Get("confirm") != "1")
+}
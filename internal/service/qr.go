@@ -0,0 +1,143 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/n1l/url-shortener/internal/qr"
+)
+
+const (
+	qrDefaultSize   = 256
+	qrMinSize       = 64
+	qrMaxSize       = 2048
+	qrDefaultMargin = 4
+	qrMaxMargin     = 16
+	qrDefaultLevel  = "M"
+
+	// qrMaxAge is how long the clients may cache a code, the codes of
+	// expiring links are cached until the expiration at most.
+	qrMaxAge = 24 * time.Hour
+)
+
+// GetQRCodeHandler answers the QR code of the short URL, a PNG or, with
+// format=svg, an SVG. The size, margin and level parameters are the
+// qr.Options.
+func (s *Service) GetQRCodeHandler(w http.ResponseWriter, r *http.Request) {
+	const parameterName = "id"
+
+	hashID := chi.URLParam(r, parameterName)
+
+	opts, format, err := qrParams(r)
+	if err != nil {
+		http.Error(w, "Bad Request! "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rec, err := s.Expand(hashID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, fmt.Sprintf("Not Found! id: '%s' not found", hashID), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrDeleted), errors.Is(err, ErrExpired):
+		http.Error(w, fmt.Sprintf("Gone! id: '%s' is no longer available", hashID), http.StatusGone)
+		return
+	case errors.Is(err, ErrUnavailable):
+		http.Error(w, "Service Unavailable!", http.StatusServiceUnavailable)
+		return
+	}
+
+	shortURL := s.ShortURL(rec.ShortURL)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d|%s", shortURL, format, opts.Size, opts.Margin, opts.Level)))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	maxAge := qrMaxAge
+	if rec.ExpiresAt != nil {
+		maxAge = min(maxAge, time.Until(*rec.ExpiresAt))
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var image []byte
+	var contentType string
+	if format == "svg" {
+		image, err = qr.SVG(shortURL, opts)
+		contentType = "image/svg+xml"
+	} else {
+		image, err = qr.PNG(shortURL, opts)
+		contentType = "image/png"
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(image)
+}
+
+func qrParams(r *http.Request) (qr.Options, string, error) {
+	query := r.URL.Query()
+	opts := qr.Options{Size: qrDefaultSize, Margin: qrDefaultMargin, Level: qrDefaultLevel}
+
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "png"
+	case "png", "svg":
+	default:
+		return opts, "", errors.New("format must be png or svg")
+	}
+
+	if size := query.Get("size"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < qrMinSize || n > qrMaxSize {
+			return opts, "", fmt.Errorf("size must be from %d to %d", qrMinSize, qrMaxSize)
+		}
+		opts.Size = n
+	}
+
+	if margin := query.Get("margin"); margin != "" {
+		n, err := strconv.Atoi(margin)
+		if err != nil || n < 0 || n > qrMaxMargin {
+			return opts, "", fmt.Errorf("margin must be from 0 to %d", qrMaxMargin)
+		}
+		opts.Margin = n
+	}
+
+	if level := query.Get("level"); level != "" {
+		if !qr.ValidLevel(level) {
+			return opts, "", errors.New("level must be one of L, M, Q and H")
+		}
+		opts.Level = strings.ToUpper(level)
+	}
+
+	return opts, format, nil
+}
+
+// etagMatches compares the If-None-Match list with the etag the weak way,
+// as the header asks for.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
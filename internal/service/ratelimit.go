@@ -0,0 +1,84 @@
+package service
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/n1l/url-shortener/internal/auth"
+	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/ratelimit"
+)
+
+func createLimit(options *config.Options) ratelimit.Limit {
+	return ratelimit.Limit{Rate: options.CreateRateLimit, Burst: options.CreateRateBurst}
+}
+
+func redirectLimit(options *config.Options) ratelimit.Limit {
+	return ratelimit.Limit{Rate: options.RedirectRateLimit, Burst: options.RedirectRateBurst}
+}
+
+// CreateRateLimitMiddleware limits how fast a client creates links.
+func (s *Service) CreateRateLimitMiddleware(h http.Handler) http.Handler {
+	return s.rateLimit(s.createLimiter, h)
+}
+
+// RedirectRateLimitMiddleware limits how fast a client follows links.
+func (s *Service) RedirectRateLimitMiddleware(h http.Handler) http.Handler {
+	return s.rateLimit(s.redirectLimiter, h)
+}
+
+// IssueRateLimitMiddleware charges the address of a client that got a new
+// auth cookie to its create limit. Every cookie gets its own bucket, so
+// minting them must not be free.
+func (s *Service) IssueRateLimitMiddleware(h http.Handler) http.Handler {
+	limited := s.rateLimit(s.createLimiter, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.Issued(r.Context()) {
+			limited.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Service) rateLimit(limiter *ratelimit.Limiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := limiter.Allow(s.rateLimitKey(r))
+		if res.Limit > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("X-RateLimit-Reset", seconds(res.Reset))
+		}
+
+		if !res.Allowed {
+			// a refused client gets no new cookie to come back with
+			w.Header().Del("Set-Cookie")
+			w.Header().Set("Retry-After", seconds(res.RetryAfter))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitKey identifies the client by its API key or the user id it
+// presented, or by its address when it has none yet, so dropping the
+// cookie does not get a fresh bucket. The address is the X-Real-IP header
+// only behind a trusted proxy, anybody can send a new one otherwise.
+func (s *Service) rateLimitKey(r *http.Request) string {
+	if key, ok := auth.KeyFromContext(r.Context()); ok {
+		return "key:" + key.ID
+	}
+	if userID, ok := auth.UserIDFromContext(r.Context()); ok && !auth.Issued(r.Context()) {
+		return "user:" + userID
+	}
+	return "ip:" + s.ClientIP(r)
+}
+
+// seconds rounds the duration up to whole seconds for the headers.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
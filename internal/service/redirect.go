@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// permanentRedirectMaxAge is how long the clients may cache a permanent
+// redirect. Browsers keep the ones without a max-age for good, so a
+// deleted or retargeted link would never reach the service again.
+const permanentRedirectMaxAge = 24 * time.Hour
+
+const defaultRedirectCode = http.StatusTemporaryRedirect
+
+func validRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// redirectCode returns the redirect status of the link, the configured
+// default for the links created without one.
+func (s *Service) redirectCode(rec *models.URLRecord) int {
+	if rec.RedirectType != 0 {
+		return rec.RedirectType
+	}
+	if code := s.opts().RedirectCode; code != 0 {
+		return code
+	}
+	return defaultRedirectCode
+}
+
+// redirectCacheControl lets the clients cache the permanent redirects,
+// until the link expires at most, and makes them come back for the
+// temporary ones, so every click is recorded. The redirects are served
+// outside the auth group, so a shared cache never keeps a user cookie.
+func redirectCacheControl(code int, rec *models.URLRecord, now time.Time) string {
+	if code != http.StatusMovedPermanently && code != http.StatusPermanentRedirect {
+		return "private, no-store"
+	}
+
+	maxAge := permanentRedirectMaxAge
+	if rec.ExpiresAt != nil {
+		maxAge = max(0, min(maxAge, rec.ExpiresAt.Sub(now)))
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
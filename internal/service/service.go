@@ -1,17 +1,76 @@
 package service
 
-import "github.com/n1l/url-shortener/internal/config"
+import (
+	"sync/atomic"
+
+	"github.com/n1l/url-shortener/internal/config"
+	"github.com/n1l/url-shortener/internal/hasher"
+	"github.com/n1l/url-shortener/internal/models"
+	"github.com/n1l/url-shortener/internal/ratelimit"
+)
 
 type Service struct {
-	URLSaver  URLSaver
-	URLGetter URLGetter
-	Options   *config.Options
+	URLSaver    URLSaver
+	URLGetter   URLGetter
+	IDGenerator hasher.IDGenerator
+	// VisitorSalt salts the hashes of the client IPs, it must survive
+	// restarts for the unique visitors to be counted once.
+	VisitorSalt string
+
+	// options are swapped as a whole on reload
+	options   atomic.Pointer[config.Options]
+	blocklist atomic.Pointer[Blocklist]
+
+	createLimiter   *ratelimit.Limiter
+	redirectLimiter *ratelimit.Limiter
+
+	deleter *batcher[models.DeletionRequest]
+	clicks  *batcher[models.Click]
+	ready   atomic.Bool
 }
 
 func NewService(options *config.Options, urlSaver URLSaver, urlGetter URLGetter) *Service {
-	return &Service{
-		Options:   options,
-		URLSaver:  urlSaver,
-		URLGetter: urlGetter,
+	s := &Service{
+		URLSaver:    urlSaver,
+		URLGetter:   urlGetter,
+		IDGenerator: hasher.HashGenerator{},
+
+		createLimiter:   ratelimit.New(createLimit(options), options.RateLimitIdle),
+		redirectLimiter: ratelimit.New(redirectLimit(options), options.RateLimitIdle),
 	}
+
+	s.options.Store(options)
+	s.deleter = s.newDeleter()
+	s.clicks = s.newClickRecorder()
+	s.ready.Store(true)
+
+	return s
+}
+
+// Reload applies the reloadable options to the running service and
+// reads the blocklist file again, the clients keep their rate limit
+// buckets. Nothing changes if the file is broken.
+func (s *Service) Reload(options *config.Options) error {
+	blocklist, err := LoadBlocklist(options.BlocklistFile)
+	if err != nil {
+		return err
+	}
+
+	s.blocklist.Store(blocklist)
+	s.createLimiter.SetLimit(createLimit(options), options.RateLimitIdle)
+	s.redirectLimiter.SetLimit(redirectLimit(options), options.RateLimitIdle)
+	s.options.Store(options)
+	return nil
+}
+
+func (s *Service) opts() *config.Options {
+	return s.options.Load()
+}
+
+// Close flushes the pending background work. It must be called after
+// the server has stopped serving requests.
+func (s *Service) Close() error {
+	s.deleter.close()
+	s.clicks.close()
+	return nil
 }
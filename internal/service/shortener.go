@@ -0,0 +1,68 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/n1l/url-shortener/internal/hasher"
+	"github.com/n1l/url-shortener/internal/models"
+	"github.com/n1l/url-shortener/internal/storage"
+)
+
+const (
+	// maxSaveAttempts bounds the number of IDs tried for a single URL.
+	maxSaveAttempts = 12
+	// attemptsPerLength is the number of collisions after which the
+	// generated IDs become one character longer.
+	attemptsPerLength = 3
+)
+
+func (s *Service) idLength() int {
+	if length := s.opts().IDLength; length > 0 {
+		return length
+	}
+	return hasher.DefaultIDLength
+}
+
+func (s *Service) generateID(url string, attempt int) string {
+	return s.IDGenerator.Generate(url, s.idLength()+attempt/attemptsPerLength, attempt)
+}
+
+// save stores rec under a generated short URL and keeps generating new
+// ones while the storage reports them as taken.
+func (s *Service) save(rec *models.URLRecord) error {
+	for attempt := 0; ; attempt++ {
+		rec.ShortURL = s.generateID(rec.OriginalURL, attempt)
+
+		err := s.URLSaver.Save(rec)
+
+		var takenErr *storage.IDTakenError
+		if !errors.As(err, &takenErr) || attempt+1 >= maxSaveAttempts {
+			return err
+		}
+	}
+}
+
+// saveBatch is the batch counterpart of save, only the records with the
+// taken short URL get a new one on retry.
+func (s *Service) saveBatch(recs []*models.URLRecord) error {
+	attempts := make([]int, len(recs))
+	for _, rec := range recs {
+		rec.ShortURL = s.generateID(rec.OriginalURL, 0)
+	}
+
+	for try := 0; ; try++ {
+		err := s.URLSaver.SaveBatch(recs)
+
+		var takenErr *storage.IDTakenError
+		if !errors.As(err, &takenErr) || try+1 >= maxSaveAttempts {
+			return err
+		}
+
+		for i, rec := range recs {
+			if rec.ShortURL == takenErr.ID {
+				attempts[i]++
+				rec.ShortURL = s.generateID(rec.OriginalURL, attempts[i])
+			}
+		}
+	}
+}
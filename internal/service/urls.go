@@ -0,0 +1,190 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+	"github.com/n1l/url-shortener/internal/storage"
+)
+
+// The methods below implement the shortener operations independently of
+// the transport, the HTTP handlers and the gRPC server translate their
+// errors into the status codes of the protocol.
+
+var (
+	ErrNotFound    = errors.New("url not found")
+	ErrDeleted     = errors.New("url has been deleted")
+	ErrExpired     = errors.New("url has expired")
+	ErrUnavailable = errors.New("service is unavailable")
+)
+
+// ValidationError reports a request the service refuses to handle,
+// Reason is one of the Reason constants.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func invalid(reason string, format string, args ...any) error {
+	return &ValidationError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// ShortURL builds the public address of the link with the short id.
+func (s *Service) ShortURL(id string) string {
+	return fmt.Sprintf("%s/%s", s.opts().PublicHost, id)
+}
+
+// Shorten stores the requested URL for the user. When the URL is already
+// stored it returns a storage.AlreadyExistsError holding the existing
+// record, a taken alias is reported as a storage.IDTakenError. The alias
+// is never replaced by another id.
+func (s *Service) Shorten(userID string, req *models.CreateShortenRequest) (*models.URLRecord, error) {
+	if err := s.ValidateURL(req.URL); err != nil {
+		return nil, err
+	}
+
+	if req.Alias != "" {
+		if err := validateAlias(req.Alias); err != nil {
+			return nil, &ValidationError{Reason: ReasonInvalidAlias, Err: err}
+		}
+	}
+
+	if req.RedirectType != 0 && !validRedirectCode(req.RedirectType) {
+		return nil, invalid(ReasonInvalidRedirectType, "redirect_type must be one of 301, 302, 307 and 308")
+	}
+
+	now := time.Now()
+	expiresAt, err := expirationOf(req, now)
+	if err != nil {
+		return nil, &ValidationError{Reason: ReasonInvalidExpiration, Err: err}
+	}
+
+	rec := &models.URLRecord{
+		OriginalURL:  req.URL,
+		UserID:       userID,
+		ExpiresAt:    expiresAt,
+		CreatedAt:    now.UTC(),
+		Interstitial: req.Interstitial,
+		RedirectType: req.RedirectType,
+	}
+
+	if req.Alias != "" {
+		rec.ShortURL = req.Alias
+		err = s.URLSaver.Save(rec)
+	} else {
+		err = s.save(rec)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// ShortenBatch stores the URLs of the batch for the user, the URLs stored
+// before keep their short URLs.
+func (s *Service) ShortenBatch(userID string, items []models.CreateShortenBatchRequestItem) ([]models.CreateShortenBatchResponseItem, error) {
+	if len(items) == 0 {
+		return nil, invalid(ReasonInvalidRequest, "empty batch")
+	}
+
+	now := time.Now().UTC()
+	recs := make([]*models.URLRecord, 0, len(items))
+	for _, item := range items {
+		if err := s.ValidateURL(item.OriginalURL); err != nil {
+			var validationErr *ValidationError
+			errors.As(err, &validationErr)
+			return nil, invalid(validationErr.Reason, "correlation_id: '%s' %w", item.CorrelationID, validationErr.Err)
+		}
+
+		recs = append(recs, &models.URLRecord{
+			OriginalURL: item.OriginalURL,
+			UserID:      userID,
+			CreatedAt:   now,
+		})
+	}
+
+	if err := s.saveBatch(recs); err != nil {
+		return nil, err
+	}
+
+	resp := make([]models.CreateShortenBatchResponseItem, 0, len(items))
+	for i, item := range items {
+		resp = append(resp, models.CreateShortenBatchResponseItem{
+			CorrelationID: item.CorrelationID,
+			ShortURL:      s.ShortURL(recs[i].ShortURL),
+		})
+	}
+	return resp, nil
+}
+
+// Expand returns the record of a working link. A failing storage is
+// reported as ErrUnavailable, not as an unknown link.
+func (s *Service) Expand(id string) (*models.URLRecord, error) {
+	rec, err := s.URLGetter.Get(id)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return nil, ErrNotFound
+	case err != nil:
+		logger.Log.Error("failed to get url", zap.String("id", id), zap.Error(err))
+		return nil, ErrUnavailable
+	case rec.DeletedFlag:
+		return nil, ErrDeleted
+	case rec.Expired(time.Now()):
+		return nil, ErrExpired
+	default:
+		return rec, nil
+	}
+}
+
+func (s *Service) UserURLs(userID string) ([]models.UserURLResponseItem, error) {
+	recs, err := s.URLGetter.GetByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the expired links stay stored until the reaper purges them, and the
+	// purged ones are left as tombstones without a user
+	now := time.Now()
+	resp := make([]models.UserURLResponseItem, 0, len(recs))
+	for _, rec := range recs {
+		if rec.Expired(now) {
+			continue
+		}
+		resp = append(resp, models.UserURLResponseItem{
+			ShortURL:    s.ShortURL(rec.ShortURL),
+			OriginalURL: rec.OriginalURL,
+		})
+	}
+	return resp, nil
+}
+
+// DeleteURLs queues the deletion of the user's links, the links of other
+// users are ignored.
+func (s *Service) DeleteURLs(userID string, ids []string) error {
+	reqs := make([]models.DeletionRequest, 0, len(ids))
+	for _, id := range ids {
+		reqs = append(reqs, models.DeletionRequest{
+			UserID:   userID,
+			ShortURL: id,
+		})
+	}
+
+	if !s.deleter.add(reqs...) {
+		return ErrUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+const dayLayout = "2006-01-02"
+
+// clickCounter aggregates the clicks of a single link.
+type clickCounter struct {
+	total    int
+	visitors map[string]struct{}
+	daily    map[string]int
+}
+
+func newClickCounter() *clickCounter {
+	return &clickCounter{
+		visitors: make(map[string]struct{}),
+		daily:    make(map[string]int),
+	}
+}
+
+func (c *clickCounter) add(click models.Click) {
+	c.total++
+	c.visitors[click.VisitorHash] = struct{}{}
+	c.daily[click.Time.UTC().Format(dayLayout)]++
+}
+
+func (c *clickCounter) stats(shortURL string) *models.LinkStats {
+	stats := &models.LinkStats{
+		ShortURL:       shortURL,
+		TotalClicks:    c.total,
+		UniqueVisitors: len(c.visitors),
+		Daily:          make([]models.DailyClicks, 0, len(c.daily)),
+	}
+	for day, clicks := range c.daily {
+		stats.Daily = append(stats.Daily, models.DailyClicks{Date: day, Clicks: clicks})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+	return stats
+}
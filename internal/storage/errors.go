@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// ErrNotFound is returned by Get when no record has the short URL.
+var ErrNotFound = errors.New("url not found")
+
+// ErrAPIKeyNotFound is returned when revoking a key that is not stored.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// ErrLocked is returned when the storage file is open in another process.
+var ErrLocked = errors.New("storage file is in use by another process")
+
+// AlreadyExistsError is returned when the original URL of a saved record
+// has already been shortened. Existing holds the stored record.
+type AlreadyExistsError struct {
+	Existing *models.URLRecord
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("url '%s' already exists with id '%s'", e.Existing.OriginalURL, e.Existing.ShortURL)
+}
+
+// IDTakenError is returned when the short URL of a saved record is
+// already used by another original URL.
+type IDTakenError struct {
+	ID string
+}
+
+func (e *IDTakenError) Error() string {
+	return fmt.Sprintf("id '%s' is already taken", e.ID)
+}
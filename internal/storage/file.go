@@ -1,74 +1,508 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"sync"
+	"time"
 
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
 	"github.com/n1l/url-shortener/internal/models"
 )
 
+// SyncPolicy tells FileStorage when to flush the written data to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways syncs the file after every write.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs the written data once a second, so a crash of
+	// the machine loses at most the last second of writes.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+const syncInterval = time.Second
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(s); policy {
+	case SyncAlways, SyncInterval, SyncNever:
+		return policy, nil
+	case "":
+		return SyncInterval, nil
+	default:
+		return "", fmt.Errorf("unknown file sync policy '%s'", s)
+	}
+}
+
+type FileOption func(s *FileStorage)
+
+func WithSyncPolicy(policy SyncPolicy) FileOption {
+	return func(s *FileStorage) {
+		s.syncPolicy = policy
+	}
+}
+
+// WithCompactThreshold makes the storage compact the file once it is
+// larger than threshold bytes and at least half of its lines are stale.
+// Zero disables the automatic compaction.
+func WithCompactThreshold(threshold int64) FileOption {
+	return func(s *FileStorage) {
+		s.compactThreshold = threshold
+	}
+}
+
 type FileStorage struct {
-	lock    sync.Mutex
-	cache   *InMemoryStorage
-	file    *os.File
-	encoder *json.Encoder
-	decoder *json.Decoder
+	lock     sync.Mutex
+	cache    *InMemoryStorage
+	filename string
+	file     *os.File
+
+	// lockFile holds the lock keeping other processes, like the compact
+	// command, away from the files while they are in use. The records file
+	// itself is replaced on compaction and cannot hold it.
+	lockFile *os.File
+
+	// size and lines describe the records file, they drive the compaction.
+	size  int64
+	lines int
+
+	// clicksFile keeps the click log next to the records file.
+	clicksFile *os.File
+
+	// keys keeps the API keys, the keys command of another process
+	// appends to them.
+	keys *KeyFile
+
+	syncPolicy       SyncPolicy
+	compactThreshold int64
+	dirty            bool
+	stopSync         chan struct{}
+	syncDone         chan struct{}
 }
 
-func NewFileStorage(filename string) (*FileStorage, error) {
+// NewFileStorage opens the storage files, it fails with ErrLocked while
+// another process has them open.
+func NewFileStorage(filename string, opts ...FileOption) (*FileStorage, error) {
+	lock, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	if err := removeStaleTemps(filename); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	clicksFile, err := os.OpenFile(filename+".clicks", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		file.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	keys, err := NewKeyFile(filename)
+	if err != nil {
+		clicksFile.Close()
+		file.Close()
+		lock.Close()
 		return nil, err
 	}
 
 	s := &FileStorage{
-		cache:   NewInMemoryStorage(),
-		file:    file,
-		encoder: json.NewEncoder(file),
-		decoder: json.NewDecoder(file),
+		cache:      NewInMemoryStorage(),
+		filename:   filename,
+		file:       file,
+		lockFile:   lock,
+		clicksFile: clicksFile,
+		keys:       keys,
+		syncPolicy: SyncInterval,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	err = s.updateFromFile()
+	if err == nil {
+		err = s.updateClicksFromFile()
+	}
 	if err != nil {
-		return nil, err
+		return nil, errors.Join(err, s.closeFiles())
+	}
+
+	if s.syncPolicy == SyncInterval {
+		s.stopSync = make(chan struct{})
+		s.syncDone = make(chan struct{})
+		go s.runSync()
 	}
 
 	return s, nil
 }
 
 func (s *FileStorage) Save(rec *models.URLRecord) error {
-	s.cache.Save(rec)
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	return s.encoder.Encode(rec)
+
+	if err := s.cache.check(rec); err != nil {
+		return err
+	}
+
+	if err := s.writeRecords([]*models.URLRecord{rec}); err != nil {
+		return err
+	}
+
+	s.cache.replace(rec)
+	return s.compactIfNeeded()
+}
+
+func (s *FileStorage) SaveBatch(recs []*models.URLRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fresh, err := s.cache.checkBatch(recs)
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeRecords(fresh); err != nil {
+		return err
+	}
+
+	s.cache.replace(fresh...)
+	return s.compactIfNeeded()
+}
+
+// MarkDeleted appends the deleted copies of the records to the file, they
+// take precedence over the earlier lines on the next start.
+func (s *FileStorage) MarkDeleted(reqs []models.DeletionRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	deleted := s.cache.checkDeletion(reqs)
+
+	if err := s.writeRecords(deleted); err != nil {
+		return err
+	}
+
+	s.cache.replace(deleted...)
+	return s.compactIfNeeded()
+}
+
+func (s *FileStorage) SaveClicks(clicks []models.Click) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, click := range clicks {
+		if err := enc.Encode(click); err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.write(s.clicksFile, buf.Bytes()); err != nil {
+		return err
+	}
+
+	return s.cache.SaveClicks(clicks)
+}
+
+func (s *FileStorage) SaveAPIKey(key *models.APIKey) error {
+	return s.keys.SaveAPIKey(key)
+}
+
+func (s *FileStorage) GetAPIKey(id string) (*models.APIKey, bool) {
+	return s.keys.GetAPIKey(id)
 }
 
-func (s *FileStorage) Get(hash string) (string, bool) {
+func (s *FileStorage) ListAPIKeys() ([]*models.APIKey, error) {
+	return s.keys.ListAPIKeys()
+}
+
+func (s *FileStorage) RevokeAPIKey(id string, at time.Time) error {
+	return s.keys.RevokeAPIKey(id, at)
+}
+
+func (s *FileStorage) Get(hash string) (*models.URLRecord, error) {
 	return s.cache.Get(hash)
 }
 
+func (s *FileStorage) GetByUser(userID string) ([]*models.URLRecord, error) {
+	return s.cache.GetByUser(userID)
+}
+
+func (s *FileStorage) GetClickStats(hash string) (*models.LinkStats, error) {
+	return s.cache.GetClickStats(hash)
+}
+
+// VisitorSalt is kept in a file next to the clicks file.
+func (s *FileStorage) VisitorSalt() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return loadOrCreateSalt(s.filename + ".salt")
+}
+
+func (s *FileStorage) CountURLs(ctx context.Context) (int, error) {
+	return s.cache.CountURLs(ctx)
+}
+
+func (s *FileStorage) CountUsers(ctx context.Context) (int, error) {
+	return s.cache.CountUsers(ctx)
+}
+
+// Ping checks that the file is still there and writable.
+func (s *FileStorage) Ping(ctx context.Context) error {
+	file, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// PurgeExpired replaces the expired records with tombstones and compacts
+// the file, so the purged ids stay taken after a restart.
+func (s *FileStorage) PurgeExpired(now time.Time) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count, err := s.cache.PurgeExpired(now)
+	if err != nil || count == 0 {
+		return count, err
+	}
+
+	return count, s.compact()
+}
+
+// Compact rewrites the file keeping only the latest line of every record.
+func (s *FileStorage) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.compact()
+}
+
 func (s *FileStorage) Close() error {
-	return s.file.Close()
+	if s.stopSync != nil {
+		close(s.stopSync)
+		<-s.syncDone
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var syncErr error
+	if s.syncPolicy != SyncNever {
+		syncErr = errors.Join(s.file.Sync(), s.clicksFile.Sync())
+	}
+
+	return errors.Join(syncErr, s.closeFiles())
 }
 
-func (s *FileStorage) updateFromFile() error {
+// closeFiles releases the lock last, after the data files are closed.
+func (s *FileStorage) closeFiles() error {
+	return errors.Join(s.file.Close(), s.clicksFile.Close(), s.keys.Close(), s.lockFile.Close())
+}
+
+func (s *FileStorage) writeRecords(recs []*models.URLRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	if err := s.write(s.file, buf.Bytes()); err != nil {
+		return err
+	}
+
+	s.size += int64(buf.Len())
+	s.lines += len(recs)
+	return nil
+}
+
+// write appends data to file and syncs it according to the sync policy.
+func (s *FileStorage) write(file *os.File, data []byte) error {
+	if err := appendAll(file, data); err != nil {
+		return err
+	}
+
+	switch s.syncPolicy {
+	case SyncAlways:
+		return file.Sync()
+	case SyncInterval:
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *FileStorage) runSync() {
+	defer close(s.syncDone)
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
 
 	for {
+		select {
+		case <-s.stopSync:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			if s.dirty {
+				if err := errors.Join(s.file.Sync(), s.clicksFile.Sync()); err != nil {
+					logger.Log.Error("failed to sync storage file", zap.String("file", s.filename), zap.Error(err))
+				} else {
+					s.dirty = false
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *FileStorage) compactIfNeeded() error {
+	if s.compactThreshold <= 0 || s.size < s.compactThreshold || s.lines < 2*s.cache.count() {
+		return nil
+	}
+
+	if err := s.compact(); err != nil {
+		// the data is safe in the old file, the next write retries
+		logger.Log.Error("failed to compact storage file", zap.String("file", s.filename), zap.Error(err))
+	}
+	return nil
+}
+
+// compact replaces the file with a snapshot of the cache holding a single
+// line per record and drops the clicks of the purged records.
+func (s *FileStorage) compact() error {
+	sizeBefore := s.size
+	var size int64
+	var lines int
+	file, err := replaceFile(s.filename, func(w io.Writer) error {
+		cw := &countingWriter{w: w}
+		enc := json.NewEncoder(cw)
+		for _, rec := range s.cache.records() {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			lines++
+		}
+		size = cw.n
+		return nil
+	})
+	if file == nil {
+		return err
+	}
+
+	// the old file is gone even if syncing the rename failed
+	s.file.Close()
+	s.file = file
+	s.size = size
+	s.lines = lines
+	if err != nil {
+		return err
+	}
+
+	logger.Log.Info("compacted storage file",
+		zap.String("file", s.filename),
+		zap.Int64("size_before", sizeBefore),
+		zap.Int64("size_after", size),
+	)
+	return s.compactClicks()
+}
+
+// compactClicks rewrites the clicks file without the clicks of the
+// records no longer stored.
+func (s *FileStorage) compactClicks() error {
+	file, err := replaceFile(s.clicksFile.Name(), func(w io.Writer) error {
+		_, _, err := readLines(s.clicksFile, func(line []byte) error {
+			var click models.Click
+			if err := json.Unmarshal(line, &click); err != nil {
+				return err
+			}
+
+			if rec, err := s.cache.Get(click.ShortURL); err != nil || purged(rec) {
+				return nil
+			}
+			_, err := w.Write(append(line, '\n'))
+			return err
+		})
+		return err
+	})
+	if file == nil {
+		return err
+	}
+
+	s.clicksFile.Close()
+	s.clicksFile = file
+	return err
+}
+
+func (s *FileStorage) updateFromFile() error {
+	size, lines, err := readLines(s.file, func(line []byte) error {
 		var rec models.URLRecord
-		if err := s.readFromFile(&rec); err == io.EOF {
-			break
-		} else if err != nil {
+		if err := json.Unmarshal(line, &rec); err != nil {
 			return err
 		}
 
 		s.cache.saveInternal(&rec)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	s.size = size
+	s.lines = lines
 	return nil
 }
 
-func (s *FileStorage) readFromFile(rec *models.URLRecord) error {
-	return s.decoder.Decode(&rec)
+// updateClicksFromFile skips the clicks of the links purged since.
+func (s *FileStorage) updateClicksFromFile() error {
+	_, _, err := readLines(s.clicksFile, func(line []byte) error {
+		var click models.Click
+		if err := json.Unmarshal(line, &click); err != nil {
+			return err
+		}
+
+		if rec, err := s.cache.Get(click.ShortURL); err == nil && !purged(rec) {
+			s.cache.SaveClicks([]models.Click{click})
+		}
+		return nil
+	})
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
@@ -1,39 +1,354 @@
 package storage
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/n1l/url-shortener/internal/models"
 )
 
+// InMemoryStorage never mutates stored records, updates replace them
+// with copies, so the records it returns are safe to read concurrently.
 type InMemoryStorage struct {
-	lock  sync.Mutex
-	cache map[string]*models.URLRecord
+	lock       sync.Mutex
+	cache      map[string]*models.URLRecord
+	byOriginal map[string]*models.URLRecord
+	clicks     map[string]*clickCounter
+	keys       apiKeys
+	salt       string
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		cache: make(map[string]*models.URLRecord),
+		cache:      make(map[string]*models.URLRecord),
+		byOriginal: make(map[string]*models.URLRecord),
+		clicks:     make(map[string]*clickCounter),
+		keys:       make(apiKeys),
 	}
 }
 
 func (s *InMemoryStorage) Save(rec *models.URLRecord) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.cache[rec.ShortURL] = rec
+	if err := s.prepare(rec); err != nil {
+		return err
+	}
+	s.saveInternal(rec)
+	return nil
+}
+
+// SaveBatch saves the records whose original URL is not stored yet and
+// points the others to the already existing short URL. Nothing is saved
+// if any of the short URLs is taken.
+func (s *InMemoryStorage) SaveBatch(recs []*models.URLRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fresh, err := s.prepareBatch(recs)
+	if err != nil {
+		return err
+	}
+	for _, rec := range fresh {
+		s.saveInternal(rec)
+	}
+	return nil
+}
+
+// MarkDeleted flags the requested records as deleted, records owned by
+// other users are left intact.
+func (s *InMemoryStorage) MarkDeleted(reqs []models.DeletionRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rec := range s.deletedCopies(reqs) {
+		s.saveInternal(rec)
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) SaveClicks(clicks []models.Click) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, click := range clicks {
+		counter, ok := s.clicks[click.ShortURL]
+		if !ok {
+			counter = newClickCounter()
+			s.clicks[click.ShortURL] = counter
+		}
+		counter.add(click)
+	}
 	return nil
 }
 
-func (s *InMemoryStorage) Get(hash string) (string, bool) {
+func (s *InMemoryStorage) Get(hash string) (*models.URLRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rec, ok := s.cache[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return rec, nil
+}
+
+func (s *InMemoryStorage) GetByUser(userID string) ([]*models.URLRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var recs []*models.URLRecord
+	for _, rec := range s.cache {
+		if rec.UserID == userID && !rec.DeletedFlag {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func (s *InMemoryStorage) GetClickStats(hash string) (*models.LinkStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counter, ok := s.clicks[hash]
+	if !ok {
+		counter = newClickCounter()
+	}
+	return counter.stats(hash), nil
+}
+
+// PurgeExpired drops the records expired by now and their clicks, leaving
+// tombstones behind so their ids are never handed out again. It returns
+// the number of purged records.
+func (s *InMemoryStorage) PurgeExpired(now time.Time) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for id, rec := range s.cache {
+		if rec.Expired(now) {
+			s.cache[id] = tombstone(rec)
+			if s.byOriginal[rec.OriginalURL] == rec {
+				delete(s.byOriginal, rec.OriginalURL)
+			}
+			delete(s.clicks, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CountURLs counts the working links, not the deleted and expired ones.
+func (s *InMemoryStorage) CountURLs(ctx context.Context) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for _, rec := range s.cache {
+		if !retired(rec) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *InMemoryStorage) CountUsers(ctx context.Context) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	users := make(map[string]struct{})
+	for _, rec := range s.cache {
+		if rec.UserID != "" {
+			users[rec.UserID] = struct{}{}
+		}
+	}
+	return len(users), nil
+}
+
+func (s *InMemoryStorage) SaveAPIKey(key *models.APIKey) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	val, ok := s.cache[hash]
-	if ok {
-		return val.OriginalURL, ok
+	if err := s.keys.check(key); err != nil {
+		return err
 	}
-	return "", ok
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *InMemoryStorage) GetAPIKey(id string) (*models.APIKey, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key, ok := s.keys[id]
+	return key, ok
 }
 
+func (s *InMemoryStorage) ListAPIKeys() ([]*models.APIKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keys.list(), nil
+}
+
+func (s *InMemoryStorage) RevokeAPIKey(id string, at time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key, err := s.keys.revoked(id, at)
+	if err != nil {
+		return err
+	}
+	s.keys[id] = key
+	return nil
+}
+
+// VisitorSalt lives as long as the clicks, for the lifetime of the
+// process.
+func (s *InMemoryStorage) VisitorSalt() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.salt == "" {
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		s.salt = salt
+	}
+	return s.salt, nil
+}
+
+func (s *InMemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *InMemoryStorage) Close() error {
+	return nil
+}
+
+// prepare reports whether rec can be saved without breaking uniqueness of
+// the original and short URLs. A deleted or expired record with the same
+// original URL does not stop rec from being saved under a new short URL,
+// its own short URL stays taken.
+func (s *InMemoryStorage) prepare(rec *models.URLRecord) error {
+	if existing, ok := s.byOriginal[rec.OriginalURL]; ok && !retired(existing) {
+		return &AlreadyExistsError{Existing: existing}
+	}
+	return s.checkIDs([]*models.URLRecord{rec})
+}
+
+// prepareBatch replaces the short URL of already stored and repeated
+// records with the existing one and returns only the records to be saved.
+func (s *InMemoryStorage) prepareBatch(recs []*models.URLRecord) ([]*models.URLRecord, error) {
+	fresh := make([]*models.URLRecord, 0, len(recs))
+	seen := make(map[string]*models.URLRecord, len(recs))
+	for _, rec := range recs {
+		if existing, ok := seen[rec.OriginalURL]; ok {
+			rec.ShortURL = existing.ShortURL
+			continue
+		}
+		if existing, ok := s.byOriginal[rec.OriginalURL]; ok && !retired(existing) {
+			rec.ShortURL = existing.ShortURL
+			continue
+		}
+		seen[rec.OriginalURL] = rec
+		fresh = append(fresh, rec)
+	}
+	if err := s.checkIDs(fresh); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// checkIDs reports the first short URL used by a stored record, even a
+// retired one, or by another record of recs with a different original URL.
+func (s *InMemoryStorage) checkIDs(recs []*models.URLRecord) error {
+	taken := make(map[string]string, len(recs))
+	for _, rec := range recs {
+		if existing, ok := s.cache[rec.ShortURL]; ok && (existing.OriginalURL != rec.OriginalURL || retired(existing)) {
+			return &IDTakenError{ID: rec.ShortURL}
+		}
+		if url, ok := taken[rec.ShortURL]; ok && url != rec.OriginalURL {
+			return &IDTakenError{ID: rec.ShortURL}
+		}
+		taken[rec.ShortURL] = rec.OriginalURL
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) deletedCopies(reqs []models.DeletionRequest) []*models.URLRecord {
+	var recs []*models.URLRecord
+	for _, req := range reqs {
+		rec, ok := s.cache[req.ShortURL]
+		if !ok || rec.UserID != req.UserID || rec.DeletedFlag {
+			continue
+		}
+		deleted := *rec
+		deleted.DeletedFlag = true
+		recs = append(recs, &deleted)
+	}
+	return recs
+}
+
+// tombstone is what is left of a purged record: its id, deleted.
+func tombstone(rec *models.URLRecord) *models.URLRecord {
+	return &models.URLRecord{ShortURL: rec.ShortURL, DeletedFlag: true}
+}
+
+// purged reports whether the record is a tombstone.
+func purged(rec *models.URLRecord) bool {
+	return rec.OriginalURL == ""
+}
+
+// retired reports whether the record no longer holds its original URL.
+func retired(rec *models.URLRecord) bool {
+	return rec.DeletedFlag || rec.Expired(time.Now())
+}
+
+// saveInternal indexes rec by its original URL unless a working record of
+// another short URL holds it, as happens when the file is read back with
+// the retired records after their replacements.
 func (s *InMemoryStorage) saveInternal(rec *models.URLRecord) {
+	if old, ok := s.cache[rec.ShortURL]; ok && s.byOriginal[old.OriginalURL] == old {
+		delete(s.byOriginal, old.OriginalURL)
+	}
 	s.cache[rec.ShortURL] = rec
+	if purged(rec) {
+		return
+	}
+	if cur, ok := s.byOriginal[rec.OriginalURL]; !ok || cur.ShortURL == rec.ShortURL || retired(cur) {
+		s.byOriginal[rec.OriginalURL] = rec
+	}
+}
+
+// The methods below let FileStorage validate changes against the cache
+// before writing them to the file and apply them afterwards.
+
+func (s *InMemoryStorage) check(rec *models.URLRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.prepare(rec)
+}
+
+func (s *InMemoryStorage) checkBatch(recs []*models.URLRecord) ([]*models.URLRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.prepareBatch(recs)
+}
+
+func (s *InMemoryStorage) checkDeletion(reqs []models.DeletionRequest) []*models.URLRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.deletedCopies(reqs)
+}
+
+func (s *InMemoryStorage) replace(recs ...*models.URLRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, rec := range recs {
+		s.saveInternal(rec)
+	}
+}
+
+func (s *InMemoryStorage) records() []*models.URLRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	recs := make([]*models.URLRecord, 0, len(s.cache))
+	for _, rec := range s.cache {
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func (s *InMemoryStorage) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.cache)
 }
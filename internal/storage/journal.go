@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+)
+
+// The helpers below deal with the JSON lines files of FileStorage. Every
+// write ends with a newline, so a last line without one is the remainder
+// of a write interrupted by a crash.
+
+// readLines calls fn for every complete line of file and truncates the
+// torn tail left by an interrupted write. It returns the size of the
+// file and the number of lines read.
+func readLines(file *os.File, fn func(line []byte) error) (int64, int, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	r := bufio.NewReader(file)
+	var offset int64
+	lines := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				logger.Log.Warn("truncating torn tail of storage file",
+					zap.String("file", file.Name()),
+					zap.Int64("offset", offset),
+					zap.Int("size", len(line)),
+				)
+				if err := file.Truncate(offset); err != nil {
+					return 0, 0, err
+				}
+			}
+			return offset, lines, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		lines++
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if err := fn(trimmed); err != nil {
+				return 0, 0, fmt.Errorf("%s:%d: %w", file.Name(), lines, err)
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+// appendAll appends data with a single write and rolls the file back
+// to its previous size if the write does not complete.
+func appendAll(file *os.File, data []byte) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		if truncErr := file.Truncate(info.Size()); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// replaceFile atomically replaces filename with the data produced by
+// write and returns the new file opened for appending. The data is
+// written and synced to a temporary file first, so the old file stays
+// intact if anything goes wrong. The new file is opened before the
+// rename and returned whenever the rename happened, even along with the
+// error of syncing the directory, so the caller never keeps writing to
+// the replaced file.
+func replaceFile(filename string, write func(w io.Writer) error) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(tmp.Name(), os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, syncDir(filepath.Dir(filename))
+}
+
+// removeStaleTemps removes the temporary files left by replaceFile when
+// the process crashed in the middle of it.
+func removeStaleTemps(filename string) error {
+	stale, err := filepath.Glob(filename + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// KeyFile keeps the API keys in a JSON lines file next to the storage
+// file. The server and the keys command use it at the same time, so it is
+// read again whenever it changes and never truncated or replaced: a last
+// line without a newline may be a write of the other process still in
+// progress and is left alone.
+type KeyFile struct {
+	lock sync.Mutex
+	file *os.File
+	keys apiKeys
+
+	// seen is the size of the file when it was last read, complete is
+	// the size of its complete lines.
+	seen     int64
+	complete int64
+}
+
+// NewKeyFile opens the keys file of the storage file filename.
+func NewKeyFile(filename string) (*KeyFile, error) {
+	file, err := os.OpenFile(filename+".keys", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KeyFile{file: file, keys: make(apiKeys), seen: -1}
+	if err := k.refresh(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+// SaveAPIKey appends the key, the keys are synced to disk right away.
+func (k *KeyFile) SaveAPIKey(key *models.APIKey) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err := k.refresh(); err != nil {
+		return err
+	}
+	if err := k.keys.check(key); err != nil {
+		return err
+	}
+	return k.write(key)
+}
+
+func (k *KeyFile) GetAPIKey(id string) (*models.APIKey, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err := k.refresh(); err != nil {
+		logger.Log.Error("failed to read api keys", zap.String("file", k.file.Name()), zap.Error(err))
+	}
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+func (k *KeyFile) ListAPIKeys() ([]*models.APIKey, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	return k.keys.list(), nil
+}
+
+// RevokeAPIKey appends the revoked copy of the key, it takes precedence
+// over the earlier line. Revoking a revoked key again writes nothing.
+func (k *KeyFile) RevokeAPIKey(id string, at time.Time) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if err := k.refresh(); err != nil {
+		return err
+	}
+	key, err := k.keys.revoked(id, at)
+	if err != nil || key == k.keys[id] {
+		return err
+	}
+	return k.write(key)
+}
+
+func (k *KeyFile) Close() error {
+	return k.file.Close()
+}
+
+// write starts a new line if the file ends with the remainder of an
+// interrupted write, so the key does not get glued to it.
+func (k *KeyFile) write(key *models.APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if k.seen > k.complete {
+		data = append([]byte{'\n'}, data...)
+	}
+
+	if err := appendAll(k.file, data); err != nil {
+		return err
+	}
+	if err := k.file.Sync(); err != nil {
+		return err
+	}
+
+	k.keys[key.ID] = key
+	k.seen += int64(len(data))
+	k.complete = k.seen
+	return nil
+}
+
+// refresh reads the file again if its size changed. The lines that are
+// not keys are the remainders of interrupted writes and are skipped.
+func (k *KeyFile) refresh() error {
+	info, err := k.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == k.seen {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.file.Name())
+	if err != nil {
+		return err
+	}
+	seen := int64(len(data))
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	keys := make(apiKeys)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var key models.APIKey
+		if err := json.Unmarshal(line, &key); err != nil || key.ID == "" {
+			logger.Log.Warn("skipping broken line of api keys file",
+				zap.String("file", k.file.Name()),
+				zap.Error(err),
+			)
+			continue
+		}
+		keys[key.ID] = &key
+	}
+
+	k.keys = keys
+	k.seen = seen
+	k.complete = int64(len(data))
+	return nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// apiKeys holds the API keys of InMemoryStorage and FileStorage, like the
+// records they are replaced with copies and never mutated.
+type apiKeys map[string]*models.APIKey
+
+func (k apiKeys) check(key *models.APIKey) error {
+	if _, ok := k[key.ID]; ok {
+		return fmt.Errorf("api key '%s' already exists", key.ID)
+	}
+	return nil
+}
+
+// revoked returns the revoked copy of the key, a key revoked earlier
+// keeps its revocation time.
+func (k apiKeys) revoked(id string, at time.Time) (*models.APIKey, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	if key.RevokedAt != nil {
+		return key, nil
+	}
+
+	revoked := *key
+	revoked.RevokedAt = &at
+	return &revoked, nil
+}
+
+// list returns the keys from the oldest to the newest.
+func (k apiKeys) list() []*models.APIKey {
+	keys := make([]*models.APIKey, 0, len(k))
+	for _, key := range k {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
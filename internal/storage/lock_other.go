@@ -0,0 +1,11 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// lockFile does nothing where flock is not available, the storage file
+// must not be opened by two processes at once there.
+func lockFile(file *os.File) error {
+	return nil
+}
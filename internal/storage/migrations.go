@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// migrations are applied in order, each one exactly once. Append new
+// statements to the end of the list and never edit the applied ones.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS urls (
+		short_url    TEXT PRIMARY KEY,
+		original_url TEXT NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_idx ON urls (original_url)`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS user_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS urls_user_id_idx ON urls (user_id)`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS is_deleted BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS urls_expires_at_idx ON urls (expires_at) WHERE expires_at IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS clicks (
+		short_url    TEXT NOT NULL REFERENCES urls (short_url) ON DELETE CASCADE,
+		clicked_at   TIMESTAMPTZ NOT NULL,
+		referrer     TEXT NOT NULL,
+		user_agent   TEXT NOT NULL,
+		visitor_hash TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS clicks_short_url_idx ON clicks (short_url, clicked_at)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id         TEXT PRIMARY KEY,
+		hash       TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		scopes     TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_type SMALLINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS retired BOOLEAN NOT NULL DEFAULT FALSE`,
+	`DROP INDEX IF EXISTS urls_original_url_idx`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_live_idx ON urls (original_url) WHERE NOT retired`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		name  TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+}
+
+// migrationsLockID serializes migrations of several instances that
+// start against the same database at once.
+const migrationsLockID = 7_243_119_001
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationsLockID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,448 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+const queryTimeout = 5 * time.Second
+
+// retireURLQuery releases the original URL held by a deleted or expired
+// record, so it can be shortened again. The retired record keeps its
+// short URL, which is never given to another record.
+const retireURLQuery = `
+	UPDATE urls SET retired = TRUE
+	WHERE original_url = $1 AND NOT retired AND (is_deleted OR COALESCE(expires_at <= now(), FALSE))`
+
+// upsertURLQuery returns the short URL stored for the original URL and
+// whether the record has just been inserted, xmax is zero for fresh rows.
+const upsertURLQuery = `
+	INSERT INTO urls (short_url, original_url, user_id, expires_at, created_at, interstitial, redirect_type)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (original_url) WHERE NOT retired DO UPDATE SET original_url = EXCLUDED.original_url
+	RETURNING short_url, xmax = 0 AS created`
+
+type PostgresStorage struct {
+	db *sql.DB
+}
+
+func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresStorage{db: db}, nil
+}
+
+func (s *PostgresStorage) Save(rec *models.URLRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	shortURL, created, err := upsertURL(ctx, tx, rec)
+	if err != nil {
+		return convertError(err, rec)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if !created {
+		return &AlreadyExistsError{Existing: &models.URLRecord{
+			ShortURL:    shortURL,
+			OriginalURL: rec.OriginalURL,
+		}}
+	}
+
+	rec.ShortURL = shortURL
+	return nil
+}
+
+func (s *PostgresStorage) SaveBatch(recs []*models.URLRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rec := range recs {
+		shortURL, _, err := upsertURL(ctx, tx, rec)
+		if err != nil {
+			return convertError(err, rec)
+		}
+		rec.ShortURL = shortURL
+	}
+
+	return tx.Commit()
+}
+
+// upsertURL retires the record holding the original URL if it is deleted
+// or expired and then inserts rec or finds the working record.
+func upsertURL(ctx context.Context, tx *sql.Tx, rec *models.URLRecord) (string, bool, error) {
+	if _, err := tx.ExecContext(ctx, retireURLQuery, rec.OriginalURL); err != nil {
+		return "", false, err
+	}
+
+	var shortURL string
+	var created bool
+	err := tx.QueryRowContext(ctx, upsertURLQuery,
+		rec.ShortURL, rec.OriginalURL, rec.UserID, rec.ExpiresAt, createdAt(rec), rec.Interstitial, rec.RedirectType).
+		Scan(&shortURL, &created)
+	return shortURL, created, err
+}
+
+// MarkDeleted flags all the requested records at once, records owned by
+// other users are left intact.
+func (s *PostgresStorage) MarkDeleted(reqs []models.DeletionRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	userIDs := make([]string, 0, len(reqs))
+	shortURLs := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		userIDs = append(userIDs, req.UserID)
+		shortURLs = append(shortURLs, req.ShortURL)
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE urls SET is_deleted = TRUE
+		FROM unnest($1::text[], $2::text[]) AS d(user_id, short_url)
+		WHERE urls.short_url = d.short_url AND urls.user_id = d.user_id`,
+		userIDs, shortURLs)
+	return err
+}
+
+func (s *PostgresStorage) SaveClicks(clicks []models.Click) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	shortURLs := make([]string, 0, len(clicks))
+	times := make([]time.Time, 0, len(clicks))
+	referrers := make([]string, 0, len(clicks))
+	userAgents := make([]string, 0, len(clicks))
+	visitorHashes := make([]string, 0, len(clicks))
+	for _, click := range clicks {
+		shortURLs = append(shortURLs, click.ShortURL)
+		times = append(times, click.Time)
+		referrers = append(referrers, click.Referrer)
+		userAgents = append(userAgents, click.UserAgent)
+		visitorHashes = append(visitorHashes, click.VisitorHash)
+	}
+
+	// the clicks of the links purged in the meantime are skipped by the join
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO clicks (short_url, clicked_at, referrer, user_agent, visitor_hash)
+		SELECT c.short_url, c.clicked_at, c.referrer, c.user_agent, c.visitor_hash
+		FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::text[], $5::text[])
+			AS c(short_url, clicked_at, referrer, user_agent, visitor_hash)
+		JOIN urls ON urls.short_url = c.short_url AND urls.original_url <> ''`,
+		shortURLs, times, referrers, userAgents, visitorHashes)
+	return err
+}
+
+// Get returns ErrNotFound for a missing record and the query error when
+// the database fails, so an outage is not mistaken for an unknown link.
+func (s *PostgresStorage) Get(hash string) (*models.URLRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	var rec models.URLRecord
+	var created sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT short_url, original_url, user_id, is_deleted, expires_at, created_at, interstitial, redirect_type
+		FROM urls WHERE short_url = $1`, hash).
+		Scan(&rec.ShortURL, &rec.OriginalURL, &rec.UserID, &rec.DeletedFlag, &rec.ExpiresAt, &created, &rec.Interstitial, &rec.RedirectType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec.CreatedAt = created.Time
+	return &rec, nil
+}
+
+func (s *PostgresStorage) GetByUser(userID string) ([]*models.URLRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT short_url, original_url, user_id, expires_at, created_at, interstitial, redirect_type
+		FROM urls WHERE user_id = $1 AND NOT is_deleted`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []*models.URLRecord
+	for rows.Next() {
+		var rec models.URLRecord
+		var created sql.NullTime
+		if err := rows.Scan(&rec.ShortURL, &rec.OriginalURL, &rec.UserID, &rec.ExpiresAt, &created, &rec.Interstitial, &rec.RedirectType); err != nil {
+			return nil, err
+		}
+		rec.CreatedAt = created.Time
+		recs = append(recs, &rec)
+	}
+
+	return recs, rows.Err()
+}
+
+func (s *PostgresStorage) GetClickStats(hash string) (*models.LinkStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	stats := &models.LinkStats{
+		ShortURL: hash,
+		Daily:    []models.DailyClicks{},
+	}
+
+	err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COUNT(DISTINCT visitor_hash) FROM clicks WHERE short_url = $1`, hash).
+		Scan(&stats.TotalClicks, &stats.UniqueVisitors)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, COUNT(*)
+		FROM clicks WHERE short_url = $1
+		GROUP BY day ORDER BY day`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var daily models.DailyClicks
+		if err := rows.Scan(&daily.Date, &daily.Clicks); err != nil {
+			return nil, err
+		}
+		stats.Daily = append(stats.Daily, daily)
+	}
+
+	return stats, rows.Err()
+}
+
+// PurgeExpired drops the expired links and their clicks, keeping their rows
+// as tombstones so their ids are never handed out again.
+func (s *PostgresStorage) PurgeExpired(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM clicks
+		WHERE short_url IN (SELECT short_url FROM urls WHERE expires_at <= $1)`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE urls
+		SET original_url = '', user_id = '', is_deleted = TRUE, retired = TRUE, expires_at = NULL
+		WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(purged), tx.Commit()
+}
+
+// VisitorSalt is created by the first instance asking for it, the other
+// ones read the same salt.
+func (s *PostgresStorage) VisitorSalt() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO settings (name, value) VALUES ('visitor_salt', $1) ON CONFLICT (name) DO NOTHING`, salt)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.QueryRowContext(ctx, `SELECT value FROM settings WHERE name = 'visitor_salt'`).Scan(&salt)
+	return salt, err
+}
+
+// SaveAPIKey stores the scopes as a comma separated list.
+func (s *PostgresStorage) SaveAPIKey(key *models.APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, hash, user_id, name, scopes, created_at, revoked_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		key.ID, key.Hash, key.UserID, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt, key.RevokedAt)
+	return err
+}
+
+func (s *PostgresStorage) GetAPIKey(id string) (*models.APIKey, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, `
+		SELECT id, hash, user_id, name, scopes, created_at, revoked_at FROM api_keys WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false
+	}
+	if err != nil {
+		logger.Log.Error("failed to get api key", zap.String("id", id), zap.Error(err))
+		return nil, false
+	}
+
+	return key, true
+}
+
+func (s *PostgresStorage) ListAPIKeys() ([]*models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, hash, user_id, name, scopes, created_at, revoked_at FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey keeps the revocation time of a key revoked earlier.
+func (s *PostgresStorage) RevokeAPIKey(id string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1`, id, at)
+	if err != nil {
+		return err
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// createdAt stores an unknown creation time as NULL, as it is for the
+// links created before the column was added.
+func createdAt(rec *models.URLRecord) *time.Time {
+	if rec.CreatedAt.IsZero() {
+		return nil
+	}
+	return &rec.CreatedAt
+}
+
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (*models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	err := row.Scan(&key.ID, &key.Hash, &key.UserID, &key.Name, &scopes, &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	return &key, nil
+}
+
+// CountURLs counts the working links, not the deleted and expired ones.
+func (s *PostgresStorage) CountURLs(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM urls WHERE NOT is_deleted AND (expires_at IS NULL OR expires_at > now())`).Scan(&count)
+	return count, err
+}
+
+func (s *PostgresStorage) CountUsers(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(DISTINCT user_id) FROM urls WHERE user_id <> ''`).Scan(&count)
+	return count, err
+}
+
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return s.db.PingContext(ctx)
+}
+
+func (s *PostgresStorage) Close() error {
+	return s.db.Close()
+}
+
+// convertError turns a primary key violation on saving rec into an
+// IDTakenError, the original URL conflicts are resolved by upsertURLQuery.
+func convertError(err error, rec *models.URLRecord) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation && pgErr.ConstraintName == "urls_pkey" {
+		return &IDTakenError{ID: rec.ShortURL}
+	}
+	return err
+}
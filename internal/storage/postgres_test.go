@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/n1l/url-shortener/internal/models"
+)
+
+// newTestPostgresStorage connects to the database from TEST_DATABASE_DSN,
+// e.g. a local `docker run -e POSTGRES_PASSWORD=postgres -p 5432:5432 postgres`,
+// and skips the test when it is not set.
+func newTestPostgresStorage(t *testing.T) *PostgresStorage {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	s, err := NewPostgresStorage(dsn)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_, err := s.db.ExecContext(context.Background(), `TRUNCATE urls, api_keys`)
+		assert.NoError(t, err)
+		s.Close()
+	})
+
+	return s
+}
+
+func TestPostgresStorageSaveAndGet(t *testing.T) {
+	s := newTestPostgresStorage(t)
+
+	err := s.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"})
+	require.NoError(t, err)
+
+	rec, err := s.Get("x7kg9X5V")
+	require.NoError(t, err)
+	assert.Equal(t, "http://google.com", rec.OriginalURL)
+
+	_, err = s.Get("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestPostgresStorageSaveBatch(t *testing.T) {
+	s := newTestPostgresStorage(t)
+
+	err := s.SaveBatch([]*models.URLRecord{
+		{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"},
+		{ShortURL: "HppQetTZ", OriginalURL: "http://eynt73dlmnjj3b.biz/t0pwb"},
+	})
+	require.NoError(t, err)
+
+	rec, err := s.Get("HppQetTZ")
+	require.NoError(t, err)
+	assert.Equal(t, "http://eynt73dlmnjj3b.biz/t0pwb", rec.OriginalURL)
+}
+
+func TestPostgresStorageMigrationsAreIdempotent(t *testing.T) {
+	s := newTestPostgresStorage(t)
+
+	require.NoError(t, migrate(context.Background(), s.db))
+}
+
+func TestPostgresStorageSaveConflict(t *testing.T) {
+	s := newTestPostgresStorage(t)
+
+	rec := &models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com"}
+	require.NoError(t, s.Save(rec))
+
+	var existsErr *AlreadyExistsError
+	err := s.Save(&models.URLRecord{ShortURL: "other", OriginalURL: "http://google.com"})
+	require.ErrorAs(t, err, &existsErr)
+	assert.Equal(t, "x7kg9X5V", existsErr.Existing.ShortURL)
+}
+
+func TestPostgresStorageMarkDeleted(t *testing.T) {
+	s := newTestPostgresStorage(t)
+
+	require.NoError(t, s.SaveBatch([]*models.URLRecord{
+		{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com", UserID: "owner"},
+		{ShortURL: "HppQe_tT", OriginalURL: "http://eynt73dlmnjj3b.biz/t0pwb", UserID: "owner"},
+	}))
+
+	require.NoError(t, s.MarkDeleted([]models.DeletionRequest{
+		{UserID: "owner", ShortURL: "x7kg9X5V"},
+		{UserID: "stranger", ShortURL: "HppQe_tT"},
+	}))
+
+	rec, err := s.Get("x7kg9X5V")
+	require.NoError(t, err)
+	assert.True(t, rec.DeletedFlag)
+
+	rec, err = s.Get("HppQe_tT")
+	require.NoError(t, err)
+	assert.False(t, rec.DeletedFlag)
+
+	recs, err := s.GetByUser("owner")
+	require.NoError(t, err)
+	assert.Len(t, recs, 1)
+
+	// the deleted id is not given out again, the URL gets a new one
+	var takenErr *IDTakenError
+	require.ErrorAs(t, s.Save(&models.URLRecord{ShortURL: "x7kg9X5V", OriginalURL: "http://google.com", UserID: "another"}), &takenErr)
+
+	rec = &models.URLRecord{ShortURL: "other", OriginalURL: "http://google.com", UserID: "another"}
+	require.NoError(t, s.Save(rec))
+	assert.Equal(t, "other", rec.ShortURL)
+
+	rec, err = s.Get("x7kg9X5V")
+	require.NoError(t, err)
+	assert.True(t, rec.DeletedFlag)
+	assert.Equal(t, "owner", rec.UserID)
+
+	var existsErr *AlreadyExistsError
+	require.ErrorAs(t, s.Save(&models.URLRecord{ShortURL: "third", OriginalURL: "http://google.com"}), &existsErr)
+	assert.Equal(t, "other", existsErr.Existing.ShortURL)
+}
+
+func TestPostgresStorageAPIKeys(t *testing.T) {
+	s := newTestPostgresStorage(t)
+
+	created := time.Now().UTC().Truncate(time.Microsecond)
+	key := &models.APIKey{ID: "k1", Hash: "h", UserID: "owner", Name: "jobs", Scopes: []string{"shorten", "stats"}, CreatedAt: created}
+	require.NoError(t, s.SaveAPIKey(key))
+
+	got, ok := s.GetAPIKey("k1")
+	require.True(t, ok)
+	assert.Equal(t, []string{"shorten", "stats"}, got.Scopes)
+	assert.Nil(t, got.RevokedAt)
+
+	require.NoError(t, s.RevokeAPIKey("k1", created.Add(time.Hour)))
+	require.NoError(t, s.RevokeAPIKey("k1", created.Add(2*time.Hour)))
+	assert.ErrorIs(t, s.RevokeAPIKey("missing", created), ErrAPIKeyNotFound)
+
+	keys, err := s.ListAPIKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.NotNil(t, keys[0].RevokedAt)
+	assert.True(t, created.Add(time.Hour).Equal(*keys[0].RevokedAt), "повторный отзыв не меняет время")
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/n1l/url-shortener/internal/logger"
+)
+
+type Purger interface {
+	PurgeExpired(now time.Time) (int, error)
+}
+
+// RunReaper purges the expired records every interval until ctx is done.
+func RunReaper(ctx context.Context, p Purger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			purged, err := p.PurgeExpired(now)
+			if err != nil {
+				logger.Log.Error("failed to purge expired urls", zap.Error(err))
+				continue
+			}
+			if purged > 0 {
+				logger.Log.Info("purged expired urls", zap.Int("count", purged))
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// The visitor salt keeps the hashes of the client IPs stable across
+// restarts, so returning visitors are not counted as unique again. Every
+// storage keeps it next to the clicks it salts.
+
+func newSalt() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// loadOrCreateSalt reads the salt from the file or replaces the missing
+// or empty file with a new one.
+func loadOrCreateSalt(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if salt := strings.TrimSpace(string(data)); salt != "" {
+		return salt, nil
+	}
+
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	file, err := replaceFile(filename, func(w io.Writer) error {
+		_, err := io.WriteString(w, salt+"\n")
+		return err
+	})
+	if file != nil {
+		file.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	return salt, nil
+}
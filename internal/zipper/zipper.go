@@ -5,17 +5,34 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/n1l/url-shortener/internal/metrics"
 )
 
 type compressWriter struct {
-	w  http.ResponseWriter
-	zw *gzip.Writer
+	w           http.ResponseWriter
+	zw          *gzip.Writer
+	wroteHeader bool
+
+	// in and out count the bytes before and after compression.
+	in  int64
+	out countingWriter
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func newCompressWriter(w http.ResponseWriter) *compressWriter {
 	return &compressWriter{
-		w:  w,
-		zw: gzip.NewWriter(w),
+		w: w,
 	}
 }
 
@@ -24,18 +41,50 @@ func (c *compressWriter) Header() http.Header {
 }
 
 func (c *compressWriter) Write(p []byte) (int, error) {
-	return c.zw.Write(p)
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.zw == nil {
+		return c.w.Write(p)
+	}
+	n, err := c.zw.Write(p)
+	c.in += int64(n)
+	return n, err
 }
 
+// WriteHeader compresses only successful responses that are not raster
+// images, the rest are passed through as is. The raster images are
+// compressed already.
 func (c *compressWriter) WriteHeader(statusCode int) {
-	if statusCode < 300 {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	if statusCode < 300 && !rasterImage(c.w.Header().Get("Content-Type")) {
 		c.w.Header().Set("Content-Encoding", "gzip")
+		c.w.Header().Del("Content-Length")
+		c.out.w = c.w
+		c.zw = gzip.NewWriter(&c.out)
 	}
 	c.w.WriteHeader(statusCode)
 }
 
+func rasterImage(contentType string) bool {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *compressWriter) Close() error {
-	return c.zw.Close()
+	if c.zw == nil {
+		return nil
+	}
+	err := c.zw.Close()
+	metrics.ObserveGzip(c.in, c.out.n)
+	return err
 }
 
 type compressReader struct {
@@ -68,6 +117,8 @@ func (c *compressReader) Close() error {
 
 func GzipMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the caches must not hand a compressed body to other clients
+		w.Header().Add("Vary", "Accept-Encoding")
 		ow := w
 
 		acceptEncoding := r.Header.Get("Accept-Encoding")
@@ -0,0 +1,447 @@
+// Package client is the Go client of the shortener HTTP API.
+//
+//	c, err := client.New("https://sho.rt", client.WithAPIKey(key))
+//	short, err := c.Shorten(ctx, client.ShortenRequest{URL: "https://go.dev"})
+//	if errors.Is(err, client.ErrConflict) {
+//		// short holds the link created earlier
+//	}
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieName is the auth cookie of the clients without an API key.
+const CookieName = "user_id"
+
+const (
+	defaultRetries    = 3
+	defaultBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// Client calls the shortener. It authenticates with the API key if it
+// has one, otherwise with the auth cookie, which it keeps from the
+// responses. It is safe for concurrent use.
+type Client struct {
+	base       *url.URL
+	http       *http.Client
+	apiKey     string
+	gzip       bool
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	lock   sync.Mutex
+	cookie string
+}
+
+type Option func(c *Client)
+
+// WithHTTPClient replaces the default client, its redirect policy is
+// overridden, the redirects are the results of Expand.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		copied := *hc
+		c.http = &copied
+	}
+}
+
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithCookie restores the auth cookie returned by Cookie earlier, so the
+// links created then stay reachable.
+func WithCookie(token string) Option {
+	return func(c *Client) {
+		c.cookie = token
+	}
+}
+
+// WithGzip compresses the request bodies.
+func WithGzip() Option {
+	return func(c *Client) {
+		c.gzip = true
+	}
+}
+
+// WithRetries sets how many times the idempotent calls are retried after
+// network errors, 429 and 502-504 responses, and the first backoff,
+// doubled on each retry. Zero retries disables them.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("base url '%s' must be an absolute http or https URL", baseURL)
+	}
+
+	c := &Client{
+		base:       base,
+		http:       &http.Client{Timeout: 30 * time.Second},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.http.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return c, nil
+}
+
+// Cookie returns the auth cookie issued by the server, empty until the
+// first call without an API key.
+func (c *Client) Cookie() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cookie
+}
+
+type ShortenRequest struct {
+	URL string
+	// Alias is the custom short id, generated if empty.
+	Alias string
+	// TTL or ExpiresAt limit the link lifetime, it lives forever without
+	// them. TTL is rounded up to whole seconds.
+	TTL       time.Duration
+	ExpiresAt *time.Time
+	// Interstitial links show a preview page before redirecting.
+	Interstitial bool
+	// RedirectType is the redirect status: 301, 302, 307 or 308, the
+	// server default if zero.
+	RedirectType int
+}
+
+type BatchItem struct {
+	CorrelationID string `json:"correlation_id"`
+	URL           string `json:"original_url"`
+}
+
+type BatchResult struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url"`
+}
+
+type Link struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+type LinkStats struct {
+	ShortURL       string        `json:"short_url"`
+	TotalClicks    int           `json:"total_clicks"`
+	UniqueVisitors int           `json:"unique_visitors"`
+	Daily          []DailyClicks `json:"daily"`
+}
+
+// Shorten returns the short URL. If the URL has been shortened before,
+// it returns the existing short URL along with an error matching
+// ErrConflict. It is not retried.
+func (c *Client) Shorten(ctx context.Context, req ShortenRequest) (string, error) {
+	if req.TTL < 0 {
+		return "", fmt.Errorf("shortener: negative TTL %s", req.TTL)
+	}
+	// the server counts whole seconds and reads zero as no expiry
+	ttlSeconds := int64((req.TTL + time.Second - 1) / time.Second)
+
+	body := struct {
+		URL          string     `json:"url"`
+		Alias        string     `json:"alias,omitempty"`
+		ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+		TTLSeconds   int64      `json:"ttl_seconds,omitempty"`
+		Interstitial bool       `json:"interstitial,omitempty"`
+		RedirectType int        `json:"redirect_type,omitempty"`
+	}{req.URL, req.Alias, req.ExpiresAt, ttlSeconds, req.Interstitial, req.RedirectType}
+
+	res, err := c.call(ctx, http.MethodPost, "/api/shorten", body, false)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var resp struct {
+		Result string `json:"result"`
+	}
+	switch res.StatusCode {
+	case http.StatusCreated:
+		if err := decode(res, &resp); err != nil {
+			return "", err
+		}
+		return resp.Result, nil
+	case http.StatusConflict:
+		// a taken alias comes as plain text without the existing link
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			return "", &Error{StatusCode: res.StatusCode, Message: "alias is already taken"}
+		}
+		return resp.Result, &Error{StatusCode: res.StatusCode, Message: "url is already shortened"}
+	default:
+		return "", readError(res)
+	}
+}
+
+// ShortenBatch shortens the URLs at once, the results are matched to the
+// items by the correlation ids. It is not retried.
+func (c *Client) ShortenBatch(ctx context.Context, items []BatchItem) ([]BatchResult, error) {
+	res, err := c.call(ctx, http.MethodPost, "/api/shorten/batch", items, false)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return nil, readError(res)
+	}
+
+	var results []BatchResult
+	return results, decode(res, &results)
+}
+
+// Expand returns the original URL of the id without following it, so
+// the lookup is not counted as a click. An unknown id matches ErrNotFound,
+// a deleted or expired one ErrGone.
+func (c *Client) Expand(ctx context.Context, id string) (string, error) {
+	res, err := c.call(ctx, http.MethodGet, "/api/urls/"+url.PathEscape(id), nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", readError(res)
+	}
+
+	var link Link
+	if err := decode(res, &link); err != nil {
+		return "", err
+	}
+	return link.OriginalURL, nil
+}
+
+// ListURLs returns the links of the user.
+func (c *Client) ListURLs(ctx context.Context) ([]Link, error) {
+	res, err := c.call(ctx, http.MethodGet, "/api/user/urls", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return []Link{}, nil
+	case http.StatusOK:
+		var links []Link
+		return links, decode(res, &links)
+	default:
+		return nil, readError(res)
+	}
+}
+
+// Delete asks to delete the links of the user, the server deletes them
+// in the background and skips the ids of other users.
+func (c *Client) Delete(ctx context.Context, ids ...string) error {
+	res, err := c.call(ctx, http.MethodDelete, "/api/user/urls", ids, true)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return readError(res)
+	}
+	return nil
+}
+
+func (c *Client) Stats(ctx context.Context, id string) (*LinkStats, error) {
+	res, err := c.call(ctx, http.MethodGet, "/api/urls/"+url.PathEscape(id)+"/stats", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, readError(res)
+	}
+
+	var stats LinkStats
+	return &stats, decode(res, &stats)
+}
+
+// call sends in as JSON, retrying the idempotent calls on network errors
+// and the responses worth retrying.
+func (c *Client) call(ctx context.Context, method, path string, in any, idempotent bool) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = c.encode(in); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, path, body)
+		if !idempotent || attempt >= c.retries || !retryable(res, err) || ctx.Err() != nil {
+			return res, err
+		}
+
+		wait := c.backoffFor(attempt)
+		if res != nil {
+			if after := retryAfter(res); after > wait {
+				wait = min(after, c.maxBackoff)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base.String()+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		if c.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	} else if cookie := c.Cookie(); cookie != "" {
+		req.AddCookie(&http.Cookie{Name: CookieName, Value: cookie})
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == CookieName {
+			c.lock.Lock()
+			c.cookie = cookie.Value
+			c.lock.Unlock()
+		}
+	}
+	return res, nil
+}
+
+func (c *Client) encode(in any) ([]byte, error) {
+	data, err := json.Marshal(in)
+	if err != nil || !c.gzip {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// backoffFor doubles the backoff on every attempt and adds up to a half
+// of it at random, so the clients retrying at once spread out.
+func (c *Client) backoffFor(attempt int) time.Duration {
+	wait := c.backoff << attempt
+	if wait <= 0 || wait > c.maxBackoff {
+		wait = c.maxBackoff
+	}
+	if half := int64(wait / 2); half > 0 {
+		wait += time.Duration(rand.Int63n(half))
+	}
+	return wait
+}
+
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func retryAfter(res *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func decode(res *http.Response, out any) error {
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("shortener: failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// readError takes the message from a JSON error body or the plain text
+// one.
+func readError(res *http.Response) *Error {
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	e := &Error{StatusCode: res.StatusCode, RetryAfter: retryAfter(res)}
+
+	var resp struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(data, &resp); err == nil && resp.Error != "" {
+		e.Message, e.Reason = resp.Error, resp.Reason
+	} else {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	return e
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"result": "http://sho.rt/a"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, WithRetries(3, time.Millisecond))
+	require.NoError(t, err)
+
+	links, err := c.ListURLs(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, links)
+	assert.Equal(t, int32(3), calls.Load(), "GET повторяется после 503")
+
+	calls.Store(0)
+	_, err = c.Shorten(context.Background(), ShortenRequest{URL: "http://google.com"})
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, int32(1), calls.Load(), "POST не повторяется")
+
+	calls.Store(0)
+	c, err = New(srv.URL, WithRetries(1, time.Millisecond))
+	require.NoError(t, err)
+	_, err = c.ListURLs(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), calls.Load(), "число повторов ограничено")
+}
+
+func TestRetryCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = c.Stats(ctx, "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "ожидание прерывается вместе с контекстом")
+
+	c, err = New(srv.URL, WithRetries(0, 0))
+	require.NoError(t, err)
+	_, err = c.Stats(context.Background(), "a")
+	require.ErrorIs(t, err, ErrRateLimited)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, time.Minute, apiErr.RetryAfter)
+}
+
+func TestExpand(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// following the short link would count a click
+		if r.URL.Path != "/api/urls/guarded1" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"short_url": "http://sho.rt/guarded1", "original_url": "http://google.com"}`))
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	original, err := c.Expand(context.Background(), "guarded1")
+	require.NoError(t, err)
+	assert.Equal(t, "http://google.com", original)
+
+	_, err = c.Expand(context.Background(), "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestShortenTTL(t *testing.T) {
+	var ttl atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			TTLSeconds int64 `json:"ttl_seconds"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		ttl.Store(body.TTLSeconds)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"result": "http://sho.rt/a"}`))
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	require.NoError(t, err)
+
+	_, err = c.Shorten(context.Background(), ShortenRequest{URL: "http://google.com", TTL: 500 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), ttl.Load(), "короткий срок не превращается в бессрочный")
+
+	_, err = c.Shorten(context.Background(), ShortenRequest{URL: "http://google.com", TTL: 90 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, int64(90), ttl.Load())
+
+	_, err = c.Shorten(context.Background(), ShortenRequest{URL: "http://google.com", TTL: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		target error
+	}{
+		{http.StatusConflict, ErrConflict},
+		{http.StatusGone, ErrGone},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusTooManyRequests, ErrRateLimited},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusBadRequest, ErrInvalid},
+	}
+	for _, tt := range tests {
+		err := error(&Error{StatusCode: tt.status})
+		assert.ErrorIs(t, err, tt.target, http.StatusText(tt.status))
+		assert.False(t, errors.Is(err, errors.New("other")))
+	}
+	assert.NotErrorIs(t, &Error{StatusCode: http.StatusInternalServerError}, ErrNotFound)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("localhost:8080")
+	assert.Error(t, err)
+
+	c, err := New("http://localhost:8080/")
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080", c.base.String())
+}
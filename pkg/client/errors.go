@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The errors the Error of a failed call matches with errors.Is.
+var (
+	ErrConflict     = errors.New("conflict")
+	ErrGone         = errors.New("gone")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrInvalid      = errors.New("invalid request")
+)
+
+// Error is an unexpected response of the server.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Reason is the machine readable cause of a rejected URL, e.g.
+	// "domain_blocked".
+	Reason string
+	// RetryAfter is the time the server asks to wait before retrying a
+	// rate limited call.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("shortener: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("shortener: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusGone:
+		return target == ErrGone
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusBadRequest:
+		return target == ErrInvalid
+	default:
+		return false
+	}
+}